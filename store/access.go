@@ -0,0 +1,728 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// ACCESS CONTROL
+// ===================================
+//
+// Instead of every handler doing its own checks before calling the store,
+// the GuardedStore wraps a Store and checks a Policy on every operation.
+// Permissions are granted to a principal on a prefix and inherited by
+// everything below it, just like folder permissions on a desktop:
+// read on "projects/" allows reading "projects/2026/plan.pdf"
+//
+// Paths in the policy are relative to the BasePrefix of the wrapped store,
+// the same paths you pass to the store. So wrap a tenant store (ForTenant)
+// to get per-tenant policies.
+//
+// The principal comes from the context, see WithPrincipal
+
+type Permission uint8
+
+const (
+	PermissionRead Permission = 1 << iota
+	PermissionWrite
+	PermissionDelete
+	PermissionShare
+
+	PermissionAll = PermissionRead | PermissionWrite | PermissionDelete | PermissionShare
+)
+
+func (p Permission) String() string {
+	var names []string
+	for _, perm := range []struct {
+		permission Permission
+		name       string
+	}{
+		{PermissionRead, "read"},
+		{PermissionWrite, "write"},
+		{PermissionDelete, "delete"},
+		{PermissionShare, "share"},
+	} {
+		if p&perm.permission != 0 {
+			names = append(names, perm.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Returned when a helper (a ContentIndex, ShareManager...) works on another
+// bucket or BasePrefix than the guarded store, so the policy wouldn't apply
+var ErrStoreMismatch = errors.New("not the guarded store")
+
+var ErrNoIndex = errors.New("the guarded store has no index")
+
+type PermissionDeniedError struct {
+	Principal  string
+	Path       string
+	Permission Permission
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied: %q needs %s on %q", e.Principal, e.Permission, e.Path)
+}
+
+func (e *PermissionDeniedError) Is(target error) bool {
+	return target == ErrPermissionDenied
+}
+
+// ===================================
+// PRINCIPALS
+// ===================================
+
+type principalKey struct{}
+
+// Attaches the principal (a user id, service account...) to the context.
+// Typically done by the authentication middleware
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+	return principal, ok && principal != ""
+}
+
+// ===================================
+// POLICY
+// ===================================
+
+// Safe for concurrent use
+type Policy struct {
+	mu     sync.RWMutex
+	grants map[string]map[string]Permission // principal -> prefix -> permissions
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		grants: map[string]map[string]Permission{},
+	}
+}
+
+// Gives the principal the permissions on the prefix and everything below it.
+// Use "" for the root
+func (p *Policy) Grant(principal, prefix string, permissions Permission) error {
+	prefix, err := CleanPath(prefix)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.grants[principal] == nil {
+		p.grants[principal] = map[string]Permission{}
+	}
+	p.grants[principal][prefix] |= permissions
+	return nil
+}
+
+// Takes away permissions granted on exactly this prefix.
+// Grants on parent directories still apply
+func (p *Policy) Revoke(principal, prefix string, permissions Permission) error {
+	prefix, err := CleanPath(prefix)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	grants := p.grants[principal]
+	if grants == nil {
+		return nil
+	}
+	grants[prefix] &^= permissions
+	if grants[prefix] == 0 {
+		delete(grants, prefix)
+	}
+	return nil
+}
+
+// Everything the principal may do on the path, including what's inherited
+func (p *Policy) Permissions(principal, objectPath string) Permission {
+	objectPath, err := CleanPath(objectPath)
+	if err != nil {
+		return 0
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	grants := p.grants[principal]
+	var result Permission
+	for current := objectPath; ; current = parentPath(current) {
+		result |= grants[current]
+		if current == "" {
+			break
+		}
+	}
+	return result
+}
+
+func (p *Policy) Allowed(principal, objectPath string, permission Permission) bool {
+	return p.Permissions(principal, objectPath)&permission == permission
+}
+
+// Whether the principal has the permission anywhere below the directory.
+// We show a directory in a listing if there is something inside it the
+// principal can get to, otherwise they could never navigate there
+func (p *Policy) allowedBelow(principal, dir string, permission Permission) bool {
+	dir, err := CleanPath(dir)
+	if err != nil {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for prefix, granted := range p.grants[principal] {
+		if granted&permission == permission && isBelow(prefix, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// "a/b/c" -> "a/b" -> "a" -> ""
+func parentPath(p string) string {
+	parent := path.Dir(p)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
+
+func isBelow(p, dir string) bool {
+	return dir == "" || strings.HasPrefix(p, dir+"/")
+}
+
+// ===================================
+// THE GUARDED STORE
+// ===================================
+
+type GuardedStore struct {
+	Store  *Store
+	Policy *Policy
+
+	// Optional. When set, listings and searches are answered by the index
+	// (of the Store, or of its parent for a tenant store) instead of GCS
+	Index *Index
+}
+
+func NewGuardedStore(s *Store, policy *Policy) *GuardedStore {
+	return &GuardedStore{
+		Store:  s,
+		Policy: policy,
+	}
+}
+
+// Checks that the principal in the context has the permission on the path
+func (g *GuardedStore) check(ctx context.Context, permission Permission, parts ...string) error {
+	objectPath, err := CleanPath(parts...)
+	if err != nil {
+		return err
+	}
+
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || !g.Policy.Allowed(principal, objectPath, permission) {
+		return &PermissionDeniedError{
+			Principal:  principal,
+			Path:       objectPath,
+			Permission: permission,
+		}
+	}
+	return nil
+}
+
+// The principal in the context. Without one, the operation on the path
+// is denied, the same way check does
+func (g *GuardedStore) principal(ctx context.Context, objectPath string, permission Permission) (string, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return "", &PermissionDeniedError{
+			Principal:  principal,
+			Path:       objectPath,
+			Permission: permission,
+		}
+	}
+	return principal, nil
+}
+
+func (g *GuardedStore) UploadFile(
+	ctx context.Context,
+	reader io.Reader,
+	prefix, filename string,
+	opts ...TransferOption,
+) (*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, filename); err != nil {
+		return nil, err
+	}
+	return g.Store.UploadFile(ctx, reader, prefix, filename, opts...)
+}
+
+func (g *GuardedStore) UploadFileParallel(
+	ctx context.Context,
+	reader io.Reader,
+	prefix, filename string,
+	parallel ParallelUploadOptions,
+	opts ...TransferOption,
+) (*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, filename); err != nil {
+		return nil, err
+	}
+	return g.Store.UploadFileParallel(ctx, reader, prefix, filename, parallel, opts...)
+}
+
+func (g *GuardedStore) DownloadFile(
+	ctx context.Context,
+	writer io.Writer,
+	prefix, filename string,
+	opts ...TransferOption,
+) (int64, error) {
+	if err := g.check(ctx, PermissionRead, prefix, filename); err != nil {
+		return 0, err
+	}
+	return g.Store.DownloadFile(ctx, writer, prefix, filename, opts...)
+}
+
+func (g *GuardedStore) CreateDirectory(
+	ctx context.Context,
+	prefix, dirName string,
+) error {
+	if err := g.check(ctx, PermissionWrite, prefix, dirName); err != nil {
+		return err
+	}
+	return g.Store.CreateDirectory(ctx, prefix, dirName)
+}
+
+// With read on the prefix, this is the same as Store.ListPaginatedObjects.
+// Otherwise, only the entries the principal can get to are returned. They are
+// filtered while paging, so the cursor and hasMore work the same way
+func (g *GuardedStore) ListPaginatedObjects(
+	ctx context.Context,
+	prefix, startAfter string,
+	limit int,
+	opts ...PageOption,
+) (
+	objects []ObjectInfo,
+	lastObjectName string,
+	hasMore bool,
+	err error,
+) {
+	keep, err := g.visibleBelow(ctx, prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	src, err := g.source()
+	if err != nil {
+		return nil, "", false, err
+	}
+	fullPrefix, err := g.Store.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	ctx, cancel := g.Store.withTimeout(ctx)
+	defer cancel()
+
+	return g.Store.paginate(ctx, src, fullPrefix, startAfter, limit, keep, opts...)
+}
+
+// Same rules as ListPaginatedObjects. We filter before paging, so the cursor
+// only ever points at entries the principal can see
+func (g *GuardedStore) ListObjects(
+	ctx context.Context,
+	prefix string,
+	opts ListOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	keep, err := g.visibleBelow(ctx, prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	src, err := g.source()
+	if err != nil {
+		return nil, "", false, err
+	}
+	fullPrefix, err := g.Store.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, "", false, err
+	}
+	entries, err := g.Store.listDirectory(ctx, src, fullPrefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if keep != nil {
+		entries = slices.DeleteFunc(entries, func(entry ObjectInfo) bool {
+			return !keep(entry)
+		})
+	}
+	return opts.page(entries)
+}
+
+// Same rules as ListPaginatedObjects, for everything below the prefix
+func (g *GuardedStore) SearchObjects(
+	ctx context.Context,
+	prefix, query string,
+	opts SearchOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	return g.scan(ctx, prefix, func(ctx context.Context, src objectSource, fullPrefix string, keep func(ObjectInfo) bool) ([]ObjectInfo, string, bool, error) {
+		return g.Store.search(ctx, src, fullPrefix, query, opts, keep)
+	})
+}
+
+// Same rules as SearchObjects
+func (g *GuardedStore) ListByTag(
+	ctx context.Context,
+	prefix, tag string,
+	opts SearchOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	return g.scan(ctx, prefix, func(ctx context.Context, src objectSource, fullPrefix string, keep func(ObjectInfo) bool) ([]ObjectInfo, string, bool, error) {
+		return g.Store.listByTag(ctx, src, fullPrefix, tag, opts, keep)
+	})
+}
+
+// Same rules as SearchObjects, so a snippet never shows the text of a file
+// the principal can't read. The index has to cover the guarded store:
+// the same store, or its parent for a tenant store
+func (g *GuardedStore) SearchContent(
+	ctx context.Context,
+	index *ContentIndex,
+	prefix, query string,
+	limit int,
+) ([]TextMatch, error) {
+	base, err := index.storeFor(g.Store.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !sameLocation(base, g.Store) {
+		return nil, fmt.Errorf("%w: the content index covers gs://%s/%s", ErrStoreMismatch, base.BucketName, base.BasePrefix)
+	}
+
+	keep, err := g.visibleBelow(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keepName func(string) bool
+	if keep != nil {
+		keepName = func(name string) bool {
+			return keep(ObjectInfo{Name: name})
+		}
+	}
+	return index.search(g.Store.TenantID, prefix, query, limit, keepName)
+}
+
+// For the scans of everything below the prefix: with read on the prefix they
+// see everything, otherwise only what the principal can get to
+func (g *GuardedStore) scan(
+	ctx context.Context,
+	prefix string,
+	scan func(ctx context.Context, src objectSource, fullPrefix string, keep func(ObjectInfo) bool) ([]ObjectInfo, string, bool, error),
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	keep, err := g.visibleBelow(ctx, prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	src, err := g.source()
+	if err != nil {
+		return nil, "", false, err
+	}
+	fullPrefix, err := g.Store.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	ctx, cancel := g.Store.withTimeout(ctx)
+	defer cancel()
+
+	return scan(ctx, src, fullPrefix, keep)
+}
+
+// Needs read on the prefix, the totals include every file below it
+func (g *GuardedStore) FolderSize(ctx context.Context, prefix string) (QuotaUsage, error) {
+	if g.Index == nil {
+		return QuotaUsage{}, ErrNoIndex
+	}
+	if _, err := g.source(); err != nil {
+		return QuotaUsage{}, err
+	}
+	if err := g.check(ctx, PermissionRead, prefix); err != nil {
+		return QuotaUsage{}, err
+	}
+	fullPrefix, err := g.Store.directoryPath(prefix)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return g.Index.folderSize(fullPrefix)
+}
+
+// What the principal may see below the prefix: nil with read on the prefix
+// (everything), a filter when they can only get to some of it, and a
+// denial when there's nothing at all
+func (g *GuardedStore) visibleBelow(ctx context.Context, prefix string) (func(ObjectInfo) bool, error) {
+	dir, err := CleanPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	principal, err := g.principal(ctx, dir, PermissionRead)
+	if err != nil {
+		return nil, err
+	}
+	if g.Policy.Allowed(principal, dir, PermissionRead) {
+		return nil, nil
+	}
+	if !g.Policy.allowedBelow(principal, dir, PermissionRead) {
+		return nil, &PermissionDeniedError{Principal: principal, Path: dir, Permission: PermissionRead}
+	}
+	return func(obj ObjectInfo) bool {
+		return g.visible(principal, path.Join(dir, obj.Name), obj.IsDir)
+	}, nil
+}
+
+// Where the listings come from: the Index when there is one, the bucket otherwise
+func (g *GuardedStore) source() (objectSource, error) {
+	if g.Index == nil {
+		return g.Store.objectSource(), nil
+	}
+	root, err := g.Store.directoryPath("")
+	if err != nil {
+		return nil, err
+	}
+	if g.Index.Store.BucketName != g.Store.BucketName || !strings.HasPrefix(root, g.Index.root) {
+		return nil, fmt.Errorf("%w: the index covers gs://%s/%s", ErrStoreMismatch, g.Index.Store.BucketName, g.Index.root)
+	}
+	return g.Index, nil
+}
+
+// Needs write, tags are part of the file
+func (g *GuardedStore) SetTags(
+	ctx context.Context,
+	prefix, objectName string,
+	tags []string,
+) (*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, objectName); err != nil {
+		return nil, err
+	}
+	return g.Store.SetTags(ctx, prefix, objectName, tags)
+}
+
+func (g *GuardedStore) GetTags(ctx context.Context, prefix, objectName string) ([]string, error) {
+	if err := g.check(ctx, PermissionRead, prefix, objectName); err != nil {
+		return nil, err
+	}
+	return g.Store.GetTags(ctx, prefix, objectName)
+}
+
+// Needs write, the file gets rewritten
+func (g *GuardedStore) SetStorageClass(
+	ctx context.Context,
+	prefix, objectName string,
+	storageClass string,
+) (*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, objectName); err != nil {
+		return nil, err
+	}
+	return g.Store.SetStorageClass(ctx, prefix, objectName, storageClass)
+}
+
+// Whether both stores resolve paths to the same objects
+func sameLocation(a, b *Store) bool {
+	return a.BucketName == b.BucketName && a.BasePrefix == b.BasePrefix
+}
+
+func (g *GuardedStore) visible(principal, objectPath string, isDir bool) bool {
+	if g.Policy.Allowed(principal, objectPath, PermissionRead) {
+		return true
+	}
+	return isDir && g.Policy.allowedBelow(principal, objectPath, PermissionRead)
+}
+
+// Needs read and delete on the source, and write on the destination
+func (g *GuardedStore) RenameObject(
+	ctx context.Context,
+	sourcePrefix, sourceObjectName string,
+	destinationPrefix, destinationObjectName string,
+) error {
+	if err := g.check(ctx, PermissionRead|PermissionDelete, sourcePrefix, sourceObjectName); err != nil {
+		return err
+	}
+	if err := g.check(ctx, PermissionWrite, destinationPrefix, destinationObjectName); err != nil {
+		return err
+	}
+	return g.Store.RenameObject(ctx, sourcePrefix, sourceObjectName, destinationPrefix, destinationObjectName)
+}
+
+// Needs read on the source, and write on the destination
+func (g *GuardedStore) CopyObject(
+	ctx context.Context,
+	sourcePrefix, sourceObjectName string,
+	destinationPrefix, destinationObjectName string,
+) (*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionRead, sourcePrefix, sourceObjectName); err != nil {
+		return nil, err
+	}
+	if err := g.check(ctx, PermissionWrite, destinationPrefix, destinationObjectName); err != nil {
+		return nil, err
+	}
+	return g.Store.CopyObject(ctx, sourcePrefix, sourceObjectName, destinationPrefix, destinationObjectName)
+}
+
+func (g *GuardedStore) DeleteObject(
+	ctx context.Context,
+	prefix, objectName string,
+) error {
+	if err := g.check(ctx, PermissionDelete, prefix, objectName); err != nil {
+		return err
+	}
+	return g.Store.DeleteObject(ctx, prefix, objectName)
+}
+
+func (g *GuardedStore) ListObjectVersions(
+	ctx context.Context,
+	prefix, objectName string,
+) ([]*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionRead, prefix, objectName); err != nil {
+		return nil, err
+	}
+	return g.Store.ListObjectVersions(ctx, prefix, objectName)
+}
+
+func (g *GuardedStore) RestoreObject(
+	ctx context.Context,
+	prefix, objectName string,
+	generation int64,
+) (*storage.ObjectAttrs, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, objectName); err != nil {
+		return nil, err
+	}
+	return g.Store.RestoreObject(ctx, prefix, objectName, generation)
+}
+
+// Signed URLs hand out access directly, so they need the same permission
+// as doing the operation through the store
+func (g *GuardedStore) SignedDownloadURL(
+	ctx context.Context,
+	prefix, filename string,
+	opts SignedURLOptions,
+) (*SignedURL, error) {
+	if err := g.check(ctx, PermissionRead, prefix, filename); err != nil {
+		return nil, err
+	}
+	return g.Store.SignedDownloadURL(prefix, filename, opts)
+}
+
+func (g *GuardedStore) SignedUploadURL(
+	ctx context.Context,
+	prefix, filename string,
+	opts SignedURLOptions,
+) (*SignedURL, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, filename); err != nil {
+		return nil, err
+	}
+	return g.Store.SignedUploadURL(prefix, filename, opts)
+}
+
+func (g *GuardedStore) SignedResumableUploadURL(
+	ctx context.Context,
+	prefix, filename string,
+	opts SignedURLOptions,
+) (*SignedURL, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, filename); err != nil {
+		return nil, err
+	}
+	return g.Store.SignedResumableUploadURL(prefix, filename, opts)
+}
+
+// Without a filename the form can upload anything under the prefix,
+// so that's where the principal needs write
+func (g *GuardedStore) SignedPostPolicy(
+	ctx context.Context,
+	prefix, filename string,
+	opts PostPolicyOptions,
+) (*PostPolicy, error) {
+	if err := g.check(ctx, PermissionWrite, prefix, filename); err != nil {
+		return nil, err
+	}
+	return g.Store.SignedPostPolicy(prefix, filename, opts)
+}
+
+// Sharing hands out read access to people outside the system,
+// so it needs share on top of read.
+// The ShareManager resolves the links against its own Store, so that has
+// to be the guarded store, otherwise the check would be for another path
+func (g *GuardedStore) ShareFile(
+	ctx context.Context,
+	shares *ShareManager,
+	prefix, filename string,
+	opts ShareOptions,
+) (*ShareLink, error) {
+	if err := g.sameShareStore(shares); err != nil {
+		return nil, err
+	}
+	if err := g.check(ctx, PermissionRead|PermissionShare, prefix, filename); err != nil {
+		return nil, err
+	}
+	return shares.ShareFile(ctx, prefix, filename, opts)
+}
+
+func (g *GuardedStore) ShareFolder(
+	ctx context.Context,
+	shares *ShareManager,
+	prefix string,
+	opts ShareOptions,
+) (*ShareLink, error) {
+	if err := g.sameShareStore(shares); err != nil {
+		return nil, err
+	}
+	if err := g.check(ctx, PermissionRead|PermissionShare, prefix); err != nil {
+		return nil, err
+	}
+	return shares.ShareFolder(ctx, prefix, opts)
+}
+
+func (g *GuardedStore) sameShareStore(shares *ShareManager) error {
+	if !sameLocation(shares.Store, g.Store) {
+		return fmt.Errorf("%w: the share links resolve against gs://%s/%s", ErrStoreMismatch, shares.Store.BucketName, shares.Store.BasePrefix)
+	}
+	return nil
+}
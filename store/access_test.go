@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	p := NewPolicy()
+	p.Grant("alice", "projects", PermissionRead)
+	p.Grant("alice", "projects/2026", PermissionWrite)
+	p.Grant("bob", "", PermissionAll)
+
+	t.Run("Permissions are inherited", func(t *testing.T) {
+		tests := []struct {
+			principal  string
+			path       string
+			permission Permission
+			expected   bool
+		}{
+			{"alice", "projects", PermissionRead, true},
+			{"alice", "projects/2025/plan.pdf", PermissionRead, true},
+			{"alice", "projects/2025/plan.pdf", PermissionWrite, false},
+			{"alice", "projects/2026/plan.pdf", PermissionRead | PermissionWrite, true},
+			{"alice", "projects/2026/plan.pdf", PermissionDelete, false},
+			{"alice", "projects-old/plan.pdf", PermissionRead, false},
+			{"alice", "other.txt", PermissionRead, false},
+			{"bob", "anything/at/all.txt", PermissionShare, true},
+			{"carol", "projects/plan.pdf", PermissionRead, false},
+			{"alice", "projects/../secret.txt", PermissionRead, false},
+		}
+
+		for _, test := range tests {
+			result := p.Allowed(test.principal, test.path, test.permission)
+			if result != test.expected {
+				t.Errorf("Allowed(%q, %q, %s): expected %v, got %v", test.principal, test.path, test.permission, test.expected, result)
+			}
+		}
+	})
+
+	t.Run("Directories leading to a grant are visible", func(t *testing.T) {
+		if !p.allowedBelow("alice", "", PermissionRead) {
+			t.Errorf("Expected the root to lead to projects")
+		}
+		if !p.allowedBelow("alice", "projects", PermissionWrite) {
+			t.Errorf("Expected projects to lead to projects/2026")
+		}
+		if p.allowedBelow("alice", "other", PermissionRead) {
+			t.Errorf("Expected nothing below other")
+		}
+	})
+
+	t.Run("Revoke only removes the exact grant", func(t *testing.T) {
+		p := NewPolicy()
+		p.Grant("alice", "", PermissionRead)
+		p.Grant("alice", "projects", PermissionRead|PermissionWrite)
+		p.Revoke("alice", "projects", PermissionRead|PermissionWrite)
+
+		if p.Allowed("alice", "projects/plan.pdf", PermissionWrite) {
+			t.Errorf("Expected write to be revoked")
+		}
+		if !p.Allowed("alice", "projects/plan.pdf", PermissionRead) {
+			t.Errorf("Expected read to still be inherited from the root")
+		}
+	})
+}
+
+func TestGuardedStoreChecks(t *testing.T) {
+	p := NewPolicy()
+	p.Grant("alice", "alice", PermissionRead|PermissionWrite)
+	g := NewGuardedStore(NewStore(nil, "bucket", "base"), p)
+
+	alice := WithPrincipal(context.Background(), "alice")
+
+	if err := g.check(alice, PermissionWrite, "alice", "notes.txt"); err != nil {
+		t.Errorf("Expected alice to write her own files, got %v", err)
+	}
+
+	err := g.check(alice, PermissionWrite, "bob", "notes.txt")
+	var denied *PermissionDeniedError
+	if !errors.As(err, &denied) || !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected a permission denied error, got %v", err)
+	}
+	if denied.Path != "bob/notes.txt" || denied.Permission != PermissionWrite {
+		t.Errorf("Unexpected error details: %+v", denied)
+	}
+
+	if err := g.check(context.Background(), PermissionRead, "alice", "notes.txt"); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected a missing principal to be denied, got %v", err)
+	}
+
+	if err := g.check(alice, PermissionRead, "alice/../..", "notes.txt"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("Expected an invalid path error, got %v", err)
+	}
+}
+
+func TestGuardedStoreListingsNeedPrincipal(t *testing.T) {
+	// Even a grant to the empty principal doesn't let a missing one through
+	p := NewPolicy()
+	p.Grant("", "", PermissionRead)
+	g := NewGuardedStore(NewStore(nil, "bucket", "base"), p)
+
+	ctx := context.Background()
+	if _, _, _, err := g.ListPaginatedObjects(ctx, "", "", 10); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("ListPaginatedObjects: expected a missing principal to be denied, got %v", err)
+	}
+	if _, _, _, err := g.ListObjects(ctx, "", ListOptions{}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("ListObjects: expected a missing principal to be denied, got %v", err)
+	}
+	if _, _, _, err := g.SearchObjects(ctx, "", "notes", SearchOptions{}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("SearchObjects: expected a missing principal to be denied, got %v", err)
+	}
+	if _, _, _, err := g.ListByTag(ctx, "", "urgent", SearchOptions{}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("ListByTag: expected a missing principal to be denied, got %v", err)
+	}
+}
+
+func TestGuardedStore(t *testing.T) {
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+
+	p := NewPolicy()
+	p.Grant("alice", "shared/alice", PermissionAll)
+	g := NewGuardedStore(s, p)
+
+	alice := WithPrincipal(h.Context, "alice")
+
+	for _, name := range []string{"shared/alice/a.txt", "shared/bob/b.txt", "private/c.txt"} {
+		if _, err := s.UploadFile(h.Context, bytes.NewReader([]byte(name)), "", name); err != nil {
+			t.Fatalf("Failed to upload %s: %v", name, err)
+		}
+	}
+
+	t.Run("Can't write outside the grant", func(t *testing.T) {
+		_, err := g.UploadFile(alice, bytes.NewReader([]byte("nope")), "shared/bob", "evil.txt")
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("Expected a permission denied error, got %v", err)
+		}
+	})
+
+	t.Run("Listing only shows what the principal can get to", func(t *testing.T) {
+		objects, _, _, err := g.ListPaginatedObjects(alice, "", "", 10)
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 1 || objects[0].Name != "shared" {
+			t.Fatalf("Expected only the shared directory, got %+v", objects)
+		}
+
+		objects, _, _, err = g.ListPaginatedObjects(alice, "shared", "", 10)
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 1 || objects[0].Name != "alice" {
+			t.Fatalf("Expected only alice's directory, got %+v", objects)
+		}
+
+		if _, _, _, err := g.ListPaginatedObjects(alice, "private", "", 10); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("Expected a permission denied error, got %v", err)
+		}
+	})
+}
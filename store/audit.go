@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// AUDIT LOG
+// ===================================
+//
+// Who uploaded, renamed or deleted what, and when.
+// Every method that changes the bucket records an AuditEvent once it's done,
+// whether it succeeded or not. Where the events go is up to the AuditSink.
+//
+// The actor is the principal in the context (see WithPrincipal).
+// Paths are the full object names in the bucket, so events from tenant
+// stores can be told apart.
+
+type Operation string
+
+const (
+	OperationUpload          Operation = "upload"
+	OperationCreateDirectory Operation = "create_directory"
+	OperationRename          Operation = "rename"
+	OperationCopy            Operation = "copy"
+	OperationDelete          Operation = "delete"
+	OperationRestore         Operation = "restore"
+	OperationSetTags         Operation = "set_tags"
+	OperationSetStorageClass Operation = "set_storage_class"
+	OperationPruneVersion    Operation = "prune_version"
+)
+
+const (
+	AuditResultOK    = "ok"
+	AuditResultError = "error"
+)
+
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Operation   Operation `json:"operation"`
+	Bucket      string    `json:"bucket"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Generation  int64     `json:"generation,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Where the audit events go.
+// Record is called after the operation already happened, so there is nothing
+// the store can do about a failing sink. Sinks deal with their own errors
+type AuditSink interface {
+	Record(ctx context.Context, event AuditEvent) error
+}
+
+// Records the outcome of an operation, see Store.mutated.
+// attrs is what the operation left behind (or removed), and may be nil
+func (s *Store) audit(
+	ctx context.Context,
+	operation Operation,
+	source, destination string,
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	if s.Audit == nil {
+		return
+	}
+
+	actor, _ := PrincipalFromContext(ctx)
+	event := AuditEvent{
+		Time:        time.Now().UTC(),
+		Actor:       actor,
+		Tenant:      s.TenantID,
+		Operation:   operation,
+		Bucket:      s.BucketName,
+		Source:      source,
+		Destination: destination,
+		Result:      AuditResultOK,
+	}
+	if attrs != nil {
+		event.Generation = attrs.Generation
+		event.Size = attrs.Size
+	}
+	if err != nil {
+		event.Result = AuditResultError
+		event.Error = err.Error()
+	}
+
+	// The operation's context is usually cancelled by now
+	s.Audit.Record(context.WithoutCancel(ctx), event)
+}
+
+// ===================================
+// SINKS
+// ===================================
+
+// Writes one JSON object per line. Safe for concurrent use
+type JSONLSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+	err     error
+}
+
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	sink := &JSONLSink{encoder: json.NewEncoder(w)}
+	if closer, ok := w.(io.Closer); ok {
+		sink.closer = closer
+	}
+	return sink
+}
+
+// Appends to the file, creating it if needed
+func OpenJSONLSink(filename string) (*JSONLSink, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", filename, err)
+	}
+	return NewJSONLSink(file), nil
+}
+
+func (j *JSONLSink) Record(ctx context.Context, event AuditEvent) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.encoder.Encode(event); err != nil {
+		// Keep the first error around, so Close can report it
+		if j.err == nil {
+			j.err = fmt.Errorf("failed to write audit event: %w", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Closes the underlying writer (if it can be closed) and reports
+// the first event that could not be written
+func (j *JSONLSink) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.err
+	if j.closer != nil {
+		if closeErr := j.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Keeps the events in memory. Meant for tests
+type MemorySink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (m *MemorySink) Record(ctx context.Context, event AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	return nil
+}
+
+// A copy of everything recorded so far, oldest first
+func (m *MemorySink) Events() []AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.events)
+}
+
+func (m *MemorySink) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = nil
+}
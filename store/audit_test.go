@@ -0,0 +1,85 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestJSONLSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLSink(&buf)
+
+	ctx := context.Background()
+	sink.Record(ctx, AuditEvent{Operation: OperationUpload, Destination: "a.txt", Result: AuditResultOK})
+	sink.Record(ctx, AuditEvent{Operation: OperationDelete, Source: "a.txt", Result: AuditResultError, Error: "boom"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per event, got %d", len(lines))
+	}
+
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.Operation != OperationDelete || event.Source != "a.txt" || event.Error != "boom" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAuditRecordsFailures(t *testing.T) {
+	// Invalid paths are rejected before the client is touched,
+	// so we can see what gets recorded without a bucket
+	sink := &MemorySink{}
+	s := NewStoreWithOptions(nil, "bucket", "base", StoreOptions{Audit: sink})
+	tenant, _ := s.ForTenant("acme")
+
+	ctx := WithPrincipal(context.Background(), "alice")
+	tenant.UploadFile(ctx, strings.NewReader("nope"), "..", "escaped.txt")
+	tenant.RenameObject(ctx, "", "a.txt", "../..", "b.txt")
+
+	events := sink.Events()
+	if len(events) != 2 {
+		t.Fatalf("Expected two events, got %d", len(events))
+	}
+
+	upload := events[0]
+	if upload.Operation != OperationUpload || upload.Result != AuditResultError {
+		t.Errorf("Unexpected upload event: %+v", upload)
+	}
+	if upload.Actor != "alice" || upload.Tenant != "acme" || upload.Bucket != "bucket" {
+		t.Errorf("Expected the actor, tenant and bucket to be set: %+v", upload)
+	}
+
+	rename := events[1]
+	if rename.Operation != OperationRename || rename.Source != "base/tenant/acme/a.txt" || rename.Destination != "" {
+		t.Errorf("Unexpected rename event: %+v", rename)
+	}
+	if !strings.Contains(rename.Error, ErrInvalidPath.Error()) {
+		t.Errorf("Expected the error to be recorded, got %q", rename.Error)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestJSONLSinkReportsWriteErrors(t *testing.T) {
+	sink := NewJSONLSink(failingWriter{})
+	if err := sink.Record(context.Background(), AuditEvent{Operation: OperationUpload}); err == nil {
+		t.Fatalf("Expected the write to fail")
+	}
+	if err := sink.Close(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Expected Close to report the failed write, got %v", err)
+	}
+}
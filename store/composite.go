@@ -0,0 +1,305 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// ===================================
+// PARALLEL COMPOSITE UPLOADS
+// ===================================
+//
+// Pushing a multi-GB file through a single Writer is slow, since every chunk
+// waits for the previous one. Instead, we can split the input into parts,
+// upload them concurrently as temporary objects and then ask GCS to stitch
+// them together. No really:
+// https://cloud.google.com/storage/docs/parallel-composite-uploads
+// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_ObjectHandle_ComposerFrom
+//
+// A few things to keep in mind:
+// 1) A compose request takes at most 32 sources, so for more parts we compose in rounds
+// 2) Composite objects don't have an MD5 hash, only a CRC32C
+// 3) The temporary parts live under <BasePrefix>/.composite/<upload id>/ until we clean them up
+// 4) A composite object is made up of at most 1024 components, so that caps the number of parts
+
+// The directory (relative to the BasePrefix) where the temporary parts are written
+const compositeTempDir = ".composite"
+
+// Whether the object is a temporary part, of this store or of one of its tenants.
+// Only <BasePrefix>/.composite/ and <BasePrefix>/tenant/<id>/.composite/ hold
+// parts, a .composite directory anywhere else is just a directory
+func isCompositePart(basePrefix, objectName string) bool {
+	root := basePrefix
+	if id := tenantOf(basePrefix, objectName); id != "" {
+		root = path.Join(basePrefix, tenantsDir, id)
+	}
+	return strings.HasPrefix(objectName, path.Join(root, compositeTempDir)+"/")
+}
+
+// The maximum number of sources GCS accepts in a single compose request
+const maxComposeSources = 32
+
+// The maximum number of components a composite object can be made of.
+// Composing intermediate objects doesn't get around it, it counts the original parts
+// https://cloud.google.com/storage/docs/composite-objects
+const maxCompositeComponents = 1024
+
+const (
+	DefaultPartSize        = 32 * 1024 * 1024
+	DefaultPartConcurrency = 4
+)
+
+// Settings for UploadFileParallel
+// Memory usage is roughly PartSize * (Concurrency + 1), plus the buffer
+// of each part's Writer (see UploadOptions)
+// If the size of the input is known and it doesn't fit in 1024 parts,
+// the PartSize is grown until it does (so the memory usage grows with it).
+// If the size is not known, inputs of more than 1024 parts are rejected
+type ParallelUploadOptions struct {
+	// Zero uses the store's UploadOptions.PartSize
+	PartSize    int64
+	Concurrency int
+}
+
+// The smallest part size, starting from partSize, that fits size bytes in
+// at most 1024 parts. An unknown size (-1) keeps the part size as is
+func partSizeFor(size, partSize int64) int64 {
+	if size < 0 || size <= partSize*maxCompositeComponents {
+		return partSize
+	}
+	// Round up, otherwise the last few bytes end up in part 1025
+	return (size + maxCompositeComponents - 1) / maxCompositeComponents
+}
+
+// Splits the reader into parts, uploads them at the same time and
+// composes them into prefix/filename.
+// The temporary parts are always removed, whether the upload succeeded or not
+func (s *Store) UploadFileParallel(
+	ctx context.Context,
+	reader io.Reader,
+	prefix, filename string,
+	parallel ParallelUploadOptions,
+	opts ...TransferOption,
+) (
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	if parallel.PartSize <= 0 {
+		parallel.PartSize = s.Upload.partSize()
+	}
+	if parallel.Concurrency <= 0 {
+		parallel.Concurrency = DefaultPartConcurrency
+	}
+
+	objectPath, err := s.objectPath(prefix, filename)
+	defer func() { s.mutated(ctx, OperationUpload, "", objectPath, attrs, err) }()
+	if err != nil {
+		return nil, err
+	}
+	cfg := newTransferConfig(opts)
+	dstObj := s.getObject(objectPath)
+	tempPrefix := path.Join(s.BasePrefix, compositeTempDir, newDefaultULID())
+
+	size := cfg.sizeOf(reader)
+	parallel.PartSize = partSizeFor(size, parallel.PartSize)
+	quota, err := s.startQuotaWrite(ctx, objectPath, size)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			quota.abort()
+		}
+	}()
+
+	// Everything we create gets tracked so that we can clean it up again
+	var temporary []*storage.ObjectHandle
+	defer func() {
+		// Use a context that survives cancellation, otherwise a cancelled
+		// upload would leave all its parts behind
+		cleanupCtx := context.WithoutCancel(ctx)
+		cleanupErr := s.deleteObjects(cleanupCtx, temporary)
+		if cleanupErr == nil {
+			return
+		}
+		cleanupErr = fmt.Errorf("failed to clean up temporary parts under %s: %w", tempPrefix, cleanupErr)
+		if committed {
+			// The object exists, so the upload did succeed. Failing it now would
+			// only make the caller retry an upload that is already there
+			log.Printf("store: %v", cleanupErr)
+			return
+		}
+		err = errors.Join(err, cleanupErr)
+	}()
+
+	// =============== // UPLOAD THE PARTS // ===============
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallel.Concurrency)
+
+	tracked := cfg.track(quota.reader(reader), size)
+	var contentType string
+	var written int64
+
+	for partNumber := 0; ; partNumber++ {
+		if gctx.Err() != nil {
+			// A part failed, no point in reading any further
+			break
+		}
+		if partNumber == maxCompositeComponents {
+			// Only reachable when the size is unknown. Anything left over
+			// would not fit in the composite object
+			n, readErr := io.ReadFull(tracked, make([]byte, 1))
+			if n == 0 && (readErr == io.EOF || readErr == io.ErrUnexpectedEOF) {
+				break
+			}
+			g.Wait()
+			if n > 0 {
+				return nil, fmt.Errorf("input does not fit in %d parts of %d bytes, set a larger PartSize", maxCompositeComponents, parallel.PartSize)
+			}
+			return nil, fmt.Errorf("failed to read part %d: %w", partNumber, readErr)
+		}
+
+		buf := s.Upload.getBuffer(int(parallel.PartSize))
+		n, readErr := io.ReadFull(tracked, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			s.Upload.putBuffer(buf)
+			// Still wait for whatever is in flight before cleaning up
+			g.Wait()
+			return nil, fmt.Errorf("failed to read part %d: %w", partNumber, readErr)
+		}
+		if n == 0 {
+			s.Upload.putBuffer(buf)
+			break
+		}
+
+		// Composed objects don't get their content type sniffed, so we do it
+		// ourselves from the start of the file (the same way the Writer would)
+		if partNumber == 0 {
+			contentType = http.DetectContentType(buf[:n])
+		}
+
+		part := s.getObject(path.Join(tempPrefix, fmt.Sprintf("part-%05d", partNumber)))
+		temporary = append(temporary, part)
+		written += int64(n)
+
+		// Blocks until there is room for another part
+		g.Go(func() error {
+			defer s.Upload.putBuffer(buf)
+			return s.uploadPart(gctx, part, buf[:n])
+		})
+
+		if readErr != nil {
+			// We hit the end of the input
+			break
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	// We might have stopped reading because the caller gave up
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// =============== // COMPOSE // ===============
+	sources := temporary
+	for round := 0; len(sources) > maxComposeSources; round++ {
+		var next []*storage.ObjectHandle
+		for i, group := range groupSources(sources, maxComposeSources) {
+			intermediate := s.getObject(path.Join(tempPrefix, fmt.Sprintf("compose-%d-%05d", round, i)))
+			temporary = append(temporary, intermediate)
+
+			if _, err := s.compose(ctx, intermediate.ComposerFrom(group...)); err != nil {
+				return nil, fmt.Errorf("failed to compose intermediate object %s: %v", intermediate.ObjectName(), err)
+			}
+			next = append(next, intermediate)
+		}
+		sources = next
+	}
+
+	if len(sources) == 0 {
+		// Nothing to compose, so we write the empty file directly
+		writer := dstObj.NewWriter(ctx)
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("failed to commit upload of %s: %w", dstObj.ObjectName(), err)
+		}
+		committed = true
+		quota.commit(0)
+		tracked.finish()
+		return writer.Attrs(), nil
+	}
+
+	composer := dstObj.ComposerFrom(sources...)
+	composer.ContentType = contentType
+	attrs, err = s.compose(ctx, composer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compose %s: %v", dstObj.ObjectName(), err)
+	}
+	committed = true
+	quota.commit(attrs.Size)
+	if attrs.Size != written {
+		return nil, fmt.Errorf("composed %s has %d bytes, but we uploaded %d", dstObj.ObjectName(), attrs.Size, written)
+	}
+
+	tracked.finish()
+	return attrs, nil
+}
+
+// Uploads a single part. Parts are brand new objects, so we set the
+// DoesNotExist precondition, which also makes the request idempotent
+func (s *Store) uploadPart(ctx context.Context, obj *storage.ObjectHandle, data []byte) error {
+	writer := s.newWriter(ctx, obj.If(storage.Conditions{DoesNotExist: true}), int64(len(data)))
+
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload part %s: %w", obj.ObjectName(), err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload part %s: %w", obj.ObjectName(), err)
+	}
+	return nil
+}
+
+// Each compose request is bound by the OperationTimeout
+func (s *Store) compose(ctx context.Context, composer *storage.Composer) (*storage.ObjectAttrs, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return composer.Run(ctx)
+}
+
+// Splits the sources into groups of at most size, keeping the order
+func groupSources[T any](sources []T, size int) [][]T {
+	var groups [][]T
+	for len(sources) > size {
+		groups = append(groups, sources[:size])
+		sources = sources[size:]
+	}
+	if len(sources) > 0 {
+		groups = append(groups, sources)
+	}
+	return groups
+}
+
+// Deletes all the objects, ignoring the ones that are already gone
+func (s *Store) deleteObjects(ctx context.Context, objects []*storage.ObjectHandle) error {
+	var errs []error
+	for _, obj := range objects {
+		opCtx, cancel := s.withTimeout(ctx)
+		if err := obj.Delete(opCtx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
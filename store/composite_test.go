@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+func TestGroupSources(t *testing.T) {
+	tests := []struct {
+		n        int
+		size     int
+		expected []int
+	}{
+		{0, 32, nil},
+		{1, 32, []int{1}},
+		{32, 32, []int{32}},
+		{33, 32, []int{32, 1}},
+		{100, 32, []int{32, 32, 32, 4}},
+	}
+
+	for _, test := range tests {
+		sources := make([]int, test.n)
+		for i := range sources {
+			sources[i] = i
+		}
+
+		groups := groupSources(sources, test.size)
+		if len(groups) != len(test.expected) {
+			t.Fatalf("groupSources(%d, %d): expected %d groups, got %d", test.n, test.size, len(test.expected), len(groups))
+		}
+
+		next := 0
+		for i, group := range groups {
+			if len(group) != test.expected[i] {
+				t.Errorf("groupSources(%d, %d): expected group %d to have %d sources, got %d", test.n, test.size, i, test.expected[i], len(group))
+			}
+			// The order has to be kept, otherwise the file gets scrambled
+			for _, source := range group {
+				if source != next {
+					t.Fatalf("groupSources(%d, %d): expected source %d, got %d", test.n, test.size, next, source)
+				}
+				next++
+			}
+		}
+	}
+}
+
+func TestIsCompositePart(t *testing.T) {
+	tests := []struct {
+		basePrefix string
+		name       string
+		expected   bool
+	}{
+		{"base", "base/.composite/01J/part-00000", true},
+		{"base", "base/tenant/acme/.composite/01J/part-00000", true},
+		{"base/tenant/acme", "base/tenant/acme/.composite/01J/part-00000", true},
+		{"", ".composite/01J/part-00000", true},
+		{"base", "base/.composite/", true},
+		// User files that happen to be in a directory with the same name
+		{"base", "base/photos/.composite/a.txt", false},
+		{"base", "base/tenant/acme/photos/.composite/a.txt", false},
+		{"base", "base/tenant/.composite/a.txt", false},
+		{"base", "other/.composite/a.txt", false},
+		{"", "photos/.composite/a.txt", false},
+		{"base", "base/.composite.txt", false},
+	}
+
+	for _, test := range tests {
+		if result := isCompositePart(test.basePrefix, test.name); result != test.expected {
+			t.Errorf("isCompositePart(%q, %q): expected %v, got %v", test.basePrefix, test.name, test.expected, result)
+		}
+	}
+}
+
+func TestParallelUpload(t *testing.T) {
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+
+	t.Run("Upload in a few parts", func(t *testing.T) {
+		const contents = "this file is uploaded in a couple of parts"
+		attrs, err := s.UploadFileParallel(h.Context, strings.NewReader(contents), "", "parts.txt", ParallelUploadOptions{
+			PartSize:    8,
+			Concurrency: 2,
+		})
+		if err != nil {
+			t.Fatalf("Failed to upload file: %v", err)
+		}
+		if attrs.Size != int64(len(contents)) {
+			t.Errorf("Expected %d bytes written, got %d", len(contents), attrs.Size)
+		}
+
+		if !h.VerifyFileContents(path.Join(h.TestPrefix, "parts.txt"), contents) {
+			t.Fatalf("Uploaded file contents do not match")
+		}
+	})
+
+	t.Run("Upload more parts than a single compose allows", func(t *testing.T) {
+		contents := bytes.Repeat([]byte("0123456789"), 5)
+		_, err := s.UploadFileParallel(h.Context, bytes.NewReader(contents), "", "many-parts.txt", ParallelUploadOptions{
+			PartSize:    1,
+			Concurrency: 8,
+		})
+		if err != nil {
+			t.Fatalf("Failed to upload file: %v", err)
+		}
+
+		if !h.VerifyFileContents(path.Join(h.TestPrefix, "many-parts.txt"), string(contents)) {
+			t.Fatalf("Uploaded file contents do not match")
+		}
+	})
+
+	t.Run("Temporary parts are cleaned up", func(t *testing.T) {
+		// Straight from the bucket, the store hides the parts from its listings
+		it := h.Client.Bucket(h.BucketName).Objects(h.Context, &storage.Query{
+			Prefix: path.Join(h.TestPrefix, compositeTempDir) + "/",
+		})
+		attrs, err := it.Next()
+		if err == nil {
+			t.Errorf("Expected no temporary parts, got %s", attrs.Name)
+		} else if err != iterator.Done {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// EVENTS
+// ===================================
+//
+// Downstream services (thumbnails, indexing...) want to know when something
+// changes in the bucket. Every change that succeeds is published as an Event
+// on the Store's EventBus, which hands it to:
+// 1) In-process subscribers, through a channel (see Subscribe)
+// 2) Webhooks, as a signed HTTP POST (see AddWebhook)
+//
+// Delivery is best effort. Nobody gets to slow the store down, so a
+// subscriber that doesn't keep up misses events. Anything that has to be
+// exact should reconcile against the bucket every now and then.
+
+type EventType string
+
+const (
+	EventObjectCreated    EventType = "object.created" // Uploads, copies and restores
+	EventObjectDeleted    EventType = "object.deleted" // The live version is gone, with versioning it's kept as noncurrent
+	EventObjectRenamed    EventType = "object.renamed"
+	EventObjectUpdated    EventType = "object.updated" // Only the metadata changed (tags), same generation
+	EventDirectoryCreated EventType = "directory.created"
+)
+
+// Where the event came from
+const (
+	EventSourceStore = "store"
+)
+
+type Event struct {
+	ID          string    `json:"id"`
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	Bucket      string    `json:"bucket"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	Name        string    `json:"name"`               // The full object name in the bucket
+	OldName     string    `json:"old_name,omitempty"` // Renames only
+	Generation  int64     `json:"generation,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+
+	// The custom metadata of the object, tags included
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Safe for concurrent use. Share a single one between a Store and its tenant stores
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	ch    chan Event
+	types []EventType
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+// Returns a channel that receives every event of the given types (all of them
+// when none are given). Events are dropped when the buffer is full.
+// Call the returned function to unsubscribe, which closes the channel
+func (b *EventBus) Subscribe(buffer int, types ...EventType) (<-chan Event, func()) {
+	sub := &subscriber{
+		ch:    make(chan Event, buffer),
+		types: types,
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// Never blocks
+func (b *EventBus) Publish(event Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers {
+		if len(sub.types) > 0 && !slices.Contains(sub.types, event.Type) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+		}
+	}
+}
+
+// Called once a method that changes the bucket is done
+func (s *Store) publish(
+	ctx context.Context,
+	operation Operation,
+	source, destination string,
+	attrs *storage.ObjectAttrs,
+) {
+	if s.Events == nil {
+		return
+	}
+
+	actor, _ := PrincipalFromContext(ctx)
+	event := Event{
+		ID:     newDefaultULID(),
+		Time:   time.Now().UTC(),
+		Source: EventSourceStore,
+		Bucket: s.BucketName,
+		Tenant: s.TenantID,
+		Actor:  actor,
+		Name:   destination,
+	}
+
+	switch operation {
+	// Changing the storage class rewrites the object, it's a new generation
+	case OperationUpload, OperationCopy, OperationRestore, OperationSetStorageClass:
+		event.Type = EventObjectCreated
+	case OperationRename:
+		event.Type = EventObjectRenamed
+		event.OldName = source
+	case OperationDelete:
+		event.Type = EventObjectDeleted
+		event.Name = source
+	case OperationCreateDirectory:
+		event.Type = EventDirectoryCreated
+	case OperationSetTags:
+		event.Type = EventObjectUpdated
+	default:
+		return
+	}
+
+	if attrs != nil {
+		event.Generation = attrs.Generation
+		event.Size = attrs.Size
+		event.ContentType = attrs.ContentType
+		// Subscribers read it in their own goroutines, while the caller
+		// still has the attrs
+		event.Metadata = maps.Clone(attrs.Metadata)
+	}
+
+	s.Events.Publish(event)
+}
+
+// ===================================
+// WEBHOOKS
+// ===================================
+
+const (
+	DefaultWebhookAttempts = 5
+	DefaultWebhookBackoff  = time.Second
+	DefaultWebhookTimeout  = 10 * time.Second
+	maxWebhookBackoff      = time.Minute
+
+	// How many events can wait for a slow webhook before we start dropping them
+	webhookQueueSize = 256
+
+	WebhookSignatureHeader = "X-Signature-256"
+	WebhookTimestampHeader = "X-Signature-Timestamp"
+	WebhookEventHeader     = "X-Event-Type"
+)
+
+type Webhook struct {
+	URL string
+
+	// Used to sign every request, see VerifyWebhookSignature
+	Secret []byte
+
+	// Only these event types get sent. All of them when empty
+	Types []EventType
+
+	// Zero values use the defaults above
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Client         *http.Client
+
+	// Optional. Called with every event that could not be delivered
+	OnError func(event Event, err error)
+}
+
+// Sends events to the webhook until the returned function is called.
+// Every webhook has its own queue, so a slow one doesn't hold up the others.
+// Stopping cancels the request in flight and whatever is still queued
+// (they end up in OnError), and waits for that to wind down
+func (b *EventBus) AddWebhook(hook Webhook) (stop func()) {
+	if hook.MaxAttempts <= 0 {
+		hook.MaxAttempts = DefaultWebhookAttempts
+	}
+	if hook.InitialBackoff <= 0 {
+		hook.InitialBackoff = DefaultWebhookBackoff
+	}
+	if hook.Client == nil {
+		hook.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+
+	events, unsubscribe := b.Subscribe(webhookQueueSize, hook.Types...)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for event := range events {
+			if err := hook.deliver(ctx, event); err != nil && hook.OnError != nil {
+				hook.OnError(event, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			cancel()
+			<-done
+		})
+	}
+}
+
+// Retries server errors, rate limiting and connection errors with an exponential backoff
+func (h Webhook) deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := h.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.send(ctx, event, body)
+		if err == nil || !retry || attempt >= h.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxWebhookBackoff)
+	}
+}
+
+func (h Webhook) send(ctx context.Context, event Event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(event.Type))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(h.Secret, timestamp, body))
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to send event %s to %s: %w", event.ID, h.URL, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("webhook %s rejected event %s: %s", h.URL, event.ID, resp.Status)
+}
+
+// The signature covers the timestamp too, so a captured request can't be
+// replayed later with a fresh timestamp. Receivers should also reject old timestamps
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// For the receiving end: checks the X-Signature-256 header against the
+// X-Signature-Timestamp header and the raw request body
+func VerifyWebhookSignature(secret []byte, timestamp string, body []byte, signature string) bool {
+	expected := signWebhook(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
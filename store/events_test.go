@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestEventBus(t *testing.T) {
+	t.Run("Subscribers only get the types they asked for", func(t *testing.T) {
+		bus := NewEventBus()
+		all, unsubscribeAll := bus.Subscribe(10)
+		deletes, unsubscribeDeletes := bus.Subscribe(10, EventObjectDeleted)
+		defer unsubscribeAll()
+		defer unsubscribeDeletes()
+
+		bus.Publish(Event{Type: EventObjectCreated, Name: "a.txt"})
+		bus.Publish(Event{Type: EventObjectDeleted, Name: "b.txt"})
+
+		if len(all) != 2 {
+			t.Errorf("Expected two events, got %d", len(all))
+		}
+		if len(deletes) != 1 || (<-deletes).Name != "b.txt" {
+			t.Errorf("Expected only the delete")
+		}
+	})
+
+	t.Run("Slow subscribers miss events instead of blocking", func(t *testing.T) {
+		bus := NewEventBus()
+		ch, unsubscribe := bus.Subscribe(1)
+
+		bus.Publish(Event{Name: "a.txt"})
+		bus.Publish(Event{Name: "b.txt"})
+
+		if event := <-ch; event.Name != "a.txt" {
+			t.Errorf("Expected the first event, got %q", event.Name)
+		}
+
+		unsubscribe()
+		unsubscribe()
+		if _, ok := <-ch; ok {
+			t.Errorf("Expected the channel to be closed")
+		}
+		bus.Publish(Event{Name: "c.txt"})
+	})
+
+	t.Run("Store operations become events", func(t *testing.T) {
+		bus := NewEventBus()
+		s := NewStoreWithOptions(nil, "bucket", "base", StoreOptions{Events: bus})
+		ch, unsubscribe := bus.Subscribe(10)
+		defer unsubscribe()
+
+		ctx := WithPrincipal(context.Background(), "alice")
+		attrs := &storage.ObjectAttrs{Generation: 7, Size: 42, ContentType: "text/plain"}
+		s.publish(ctx, OperationUpload, "", "base/a.txt", attrs)
+		s.publish(ctx, OperationRename, "base/a.txt", "base/b.txt", attrs)
+		s.publish(ctx, OperationDelete, "base/b.txt", "", attrs)
+		s.publish(ctx, OperationSetTags, "", "base/c.txt", attrs)
+
+		// Failures are audited, but never published
+		s.mutated(ctx, OperationCopy, "base/b.txt", "base/c.txt", nil, storage.ErrObjectNotExist)
+
+		expected := []Event{
+			{Type: EventObjectCreated, Name: "base/a.txt"},
+			{Type: EventObjectRenamed, Name: "base/b.txt", OldName: "base/a.txt"},
+			{Type: EventObjectDeleted, Name: "base/b.txt"},
+			{Type: EventObjectUpdated, Name: "base/c.txt"},
+		}
+		if len(ch) != len(expected) {
+			t.Fatalf("Expected %d events, got %d", len(expected), len(ch))
+		}
+		for i, want := range expected {
+			got := <-ch
+			if got.Type != want.Type || got.Name != want.Name || got.OldName != want.OldName {
+				t.Errorf("Event(%d): expected %+v, got %+v", i, want, got)
+			}
+			if got.ID == "" || got.Actor != "alice" || got.Generation != 7 || got.Size != 42 || got.Source != EventSourceStore {
+				t.Errorf("Event(%d): missing details: %+v", i, got)
+			}
+		}
+	})
+
+	t.Run("Events get their own copy of the metadata", func(t *testing.T) {
+		bus := NewEventBus()
+		s := NewStoreWithOptions(nil, "bucket", "base", StoreOptions{Events: bus})
+		ch, unsubscribe := bus.Subscribe(1)
+		defer unsubscribe()
+
+		attrs := &storage.ObjectAttrs{Metadata: map[string]string{tagsMetadataKey: "invoice"}}
+		s.publish(context.Background(), OperationSetTags, "", "base/a.txt", attrs)
+		attrs.Metadata[tagsMetadataKey] = "changed"
+
+		if got := (<-ch).Metadata[tagsMetadataKey]; got != "invoice" {
+			t.Errorf("Expected the metadata at the time of the event, got %q", got)
+		}
+	})
+}
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("shh")
+
+	t.Run("Signed and retried", func(t *testing.T) {
+		var attempts atomic.Int32
+		received := make(chan Event, 1)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if !VerifyWebhookSignature(secret, r.Header.Get(WebhookTimestampHeader), body, r.Header.Get(WebhookSignatureHeader)) {
+				t.Errorf("Invalid signature")
+			}
+
+			// Fail the first time, so it gets retried
+			if attempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			var event Event
+			json.Unmarshal(body, &event)
+			received <- event
+		}))
+		defer server.Close()
+
+		bus := NewEventBus()
+		stop := bus.AddWebhook(Webhook{URL: server.URL, Secret: secret, InitialBackoff: time.Millisecond})
+		defer stop()
+
+		bus.Publish(Event{ID: "1", Type: EventObjectCreated, Name: "a.txt"})
+
+		select {
+		case event := <-received:
+			if event.Name != "a.txt" {
+				t.Errorf("Unexpected event: %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Webhook never received the event")
+		}
+		if attempts.Load() != 2 {
+			t.Errorf("Expected two attempts, got %d", attempts.Load())
+		}
+	})
+
+	t.Run("Client errors are not retried", func(t *testing.T) {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		failed := make(chan Event, 1)
+		bus := NewEventBus()
+		stop := bus.AddWebhook(Webhook{
+			URL:            server.URL,
+			Secret:         secret,
+			InitialBackoff: time.Millisecond,
+			OnError:        func(event Event, err error) { failed <- event },
+		})
+		defer stop()
+
+		bus.Publish(Event{ID: "1", Type: EventObjectCreated})
+
+		select {
+		case <-failed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the delivery to fail")
+		}
+		if attempts.Load() != 1 {
+			t.Errorf("Expected a single attempt, got %d", attempts.Load())
+		}
+	})
+
+	t.Run("Tampered bodies don't verify", func(t *testing.T) {
+		signature := signWebhook(secret, "1700000000", []byte(`{"name":"a.txt"}`))
+		if VerifyWebhookSignature(secret, "1700000000", []byte(`{"name":"b.txt"}`), signature) {
+			t.Errorf("Expected a different body to fail")
+		}
+		if VerifyWebhookSignature(secret, "1700000001", []byte(`{"name":"a.txt"}`), signature) {
+			t.Errorf("Expected a different timestamp to fail")
+		}
+	})
+}
@@ -0,0 +1,482 @@
+package store
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// FULL-TEXT SEARCH
+// ===================================
+//
+// SearchObjects only looks at the names. The ContentIndex looks inside text,
+// Markdown, CSV and JSON files: every upload gets downloaded through the
+// Store, split into words, and added to an inverted index (word -> files).
+// Every tenant has an index of its own, so a query never even looks at the
+// files of another tenant.
+//
+// The index lives in memory and keeps the text of every file for the
+// snippets, which is why there's a cap on the size of the files. It starts
+// empty, Backfill adds the files that were there before.
+//
+// There's no parsing of the formats: Markdown, CSV and JSON are plain text
+// with some punctuation, and the punctuation never ends up in a word.
+
+const DefaultMaxTextFileSize = 8 * 1024 * 1024
+
+const (
+	minTermLength = 2
+	maxTermLength = 64
+	snippetLength = 160
+	textQueueSize = 256
+)
+
+var textExtensions = []string{".txt", ".md", ".markdown", ".csv", ".json"}
+
+// A file that matched a query
+type TextMatch struct {
+	Name  string  `json:"name"` // Relative to the prefix searched
+	Score float64 `json:"score"`
+
+	// The text around the first match, with the byte ranges of the words
+	// of the query in it, to highlight them
+	Snippet    string   `json:"snippet"`
+	Highlights [][2]int `json:"highlights"`
+}
+
+type ContentIndex struct {
+	Store *Store
+
+	// Larger files aren't indexed. Defaults to DefaultMaxTextFileSize
+	MaxFileSize int64
+
+	mu      sync.RWMutex
+	tenants map[string]*invertedIndex // "" for everything outside the tenants
+
+	// Where the text comes from. The Store, or a map in the tests
+	read func(ctx context.Context, objectName string) ([]byte, error)
+}
+
+type invertedIndex struct {
+	docs     map[string]*textDocument       // By full object name
+	postings map[string]map[string]struct{} // Term -> full object names
+}
+
+type textDocument struct {
+	text   string
+	terms  map[string][]int // Term -> byte offsets in the text
+	length int              // In terms
+}
+
+func NewContentIndex(s *Store) *ContentIndex {
+	c := &ContentIndex{
+		Store:       s,
+		MaxFileSize: DefaultMaxTextFileSize,
+		tenants:     map[string]*invertedIndex{},
+	}
+	c.read = c.download
+	return c
+}
+
+// Only text files that aren't too large, and never our temporary parts
+func (c *ContentIndex) indexable(objectName string, size int64) bool {
+	root, _ := c.Store.directoryPath("")
+	if !strings.HasPrefix(objectName, root) || isCompositePart(c.Store.BasePrefix, objectName) {
+		return false
+	}
+	if size > c.maxFileSize() {
+		return false
+	}
+	return slices.Contains(textExtensions, strings.ToLower(path.Ext(objectName)))
+}
+
+func (c *ContentIndex) maxFileSize() int64 {
+	if c.MaxFileSize <= 0 {
+		return DefaultMaxTextFileSize
+	}
+	return c.MaxFileSize
+}
+
+// Reads the whole file through the Store
+func (c *ContentIndex) download(ctx context.Context, objectName string) ([]byte, error) {
+	root, _ := c.Store.directoryPath("")
+	var buf bytes.Buffer
+	if _, err := c.Store.DownloadFile(ctx, &buf, "", strings.TrimPrefix(objectName, root)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ===================================
+// INDEXING
+// ===================================
+
+// Indexes the uploads (and forgets the deletes) published on the Store's EventBus.
+// Call the returned function to stop
+func (c *ContentIndex) Sync(onError func(event Event, err error)) (stop func()) {
+	if c.Store.Events == nil {
+		return func() {}
+	}
+
+	events, unsubscribe := c.Store.Events.Subscribe(textQueueSize,
+		EventObjectCreated, EventObjectRenamed, EventObjectDeleted)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for event := range events {
+			if err := c.Apply(ctx, event); err != nil && onError != nil {
+				onError(event, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			cancel()
+			<-done
+		})
+	}
+}
+
+// Updates the index with a single event
+func (c *ContentIndex) Apply(ctx context.Context, event Event) error {
+	if event.Bucket != "" && event.Bucket != c.Store.BucketName {
+		return nil
+	}
+
+	switch event.Type {
+	case EventObjectCreated:
+		return c.IndexObject(ctx, event.Name, event.Size)
+	case EventObjectDeleted:
+		c.remove(event.Name)
+	case EventObjectRenamed:
+		// Same contents, no need to download them again
+		if doc := c.remove(event.OldName); doc != nil && c.indexable(event.Name, int64(len(doc.text))) {
+			c.add(event.Name, doc)
+			return nil
+		}
+		return c.IndexObject(ctx, event.Name, event.Size)
+	}
+	return nil
+}
+
+// Downloads and indexes a file, by its full name.
+// Anything that isn't a text file (see textExtensions), or is too large, is left out
+func (c *ContentIndex) IndexObject(ctx context.Context, objectName string, size int64) error {
+	if !c.indexable(objectName, size) {
+		c.remove(objectName)
+		return nil
+	}
+
+	data, err := c.read(ctx, objectName)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", objectName, err)
+	}
+	// Don't trust the size we were told
+	if int64(len(data)) > c.maxFileSize() {
+		c.remove(objectName)
+		return nil
+	}
+
+	c.add(objectName, newTextDocument(strings.ToValidUTF8(string(data), "�")))
+	return nil
+}
+
+// Indexes the text files that are already in the bucket
+func (c *ContentIndex) Backfill(ctx context.Context) error {
+	return c.backfill(ctx, c.Store.objectSource())
+}
+
+func (c *ContentIndex) backfill(ctx context.Context, src objectSource) error {
+	root, err := c.Store.directoryPath("")
+	if err != nil {
+		return err
+	}
+	q := &storage.Query{Prefix: root}
+	if err := q.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+		return err
+	}
+
+	it := src.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		if !c.indexable(attrs.Name, attrs.Size) {
+			continue
+		}
+		if err := c.IndexObject(ctx, attrs.Name, attrs.Size); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *ContentIndex) add(objectName string, doc *textDocument) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(objectName)
+
+	tenant := c.tenantOf(objectName)
+	idx, ok := c.tenants[tenant]
+	if !ok {
+		idx = &invertedIndex{
+			docs:     map[string]*textDocument{},
+			postings: map[string]map[string]struct{}{},
+		}
+		c.tenants[tenant] = idx
+	}
+
+	idx.docs[objectName] = doc
+	for term := range doc.terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = map[string]struct{}{}
+		}
+		idx.postings[term][objectName] = struct{}{}
+	}
+}
+
+// Returns what was indexed, if anything
+func (c *ContentIndex) remove(objectName string) *textDocument {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removeLocked(objectName)
+}
+
+func (c *ContentIndex) removeLocked(objectName string) *textDocument {
+	idx, ok := c.tenants[c.tenantOf(objectName)]
+	if !ok {
+		return nil
+	}
+	doc, ok := idx.docs[objectName]
+	if !ok {
+		return nil
+	}
+
+	delete(idx.docs, objectName)
+	for term := range doc.terms {
+		delete(idx.postings[term], objectName)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	return doc
+}
+
+// Relative to the Store, so for a Store of a tenant it's always ""
+func (c *ContentIndex) tenantOf(objectName string) string {
+	return tenantOf(c.Store.BasePrefix, objectName)
+}
+
+func newTextDocument(text string) *textDocument {
+	doc := &textDocument{
+		text:  text,
+		terms: map[string][]int{},
+	}
+	for _, token := range tokenize(text) {
+		doc.terms[token.term] = append(doc.terms[token.term], token.start)
+		doc.length++
+	}
+	return doc
+}
+
+type textToken struct {
+	term       string
+	start, end int // Byte offsets
+}
+
+// Splits on anything that isn't a letter or a digit, and lowercases.
+// Words that are too short or too long to be worth searching are dropped
+func tokenize(text string) []textToken {
+	var tokens []textToken
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		word := text[start:end]
+		if n := utf8.RuneCountInString(word); n >= minTermLength && n <= maxTermLength {
+			tokens = append(tokens, textToken{term: strings.ToLower(word), start: start, end: end})
+		}
+		start = -1
+	}
+
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		flush(i)
+	}
+	flush(len(text))
+	return tokens
+}
+
+// ===================================
+// QUERIES
+// ===================================
+
+// Finds the files under prefix (of the tenant, "" for everything outside the
+// tenants) that contain every word of the query, best matches first.
+// Words are matched whole and case-insensitive, "report" doesn't find "reports".
+// There are no permission checks, use GuardedStore.SearchContent for those
+func (c *ContentIndex) Search(tenant, prefix, query string, limit int) ([]TextMatch, error) {
+	return c.search(tenant, prefix, query, limit, nil)
+}
+
+// The Store of the tenant, "" for the Store itself
+func (c *ContentIndex) storeFor(tenant string) (*Store, error) {
+	if tenant == "" {
+		return c.Store, nil
+	}
+	return c.Store.ForTenant(tenant)
+}
+
+// When keep is set, only the files (relative to the prefix) it keeps
+// are matches. They're filtered before the limit is applied
+func (c *ContentIndex) search(tenant, prefix, query string, limit int, keep func(name string) bool) ([]TextMatch, error) {
+	base, err := c.storeFor(tenant)
+	if err != nil {
+		return nil, err
+	}
+	fullPrefix, err := base.directoryPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	var terms []string
+	for _, token := range tokenize(query) {
+		if !slices.Contains(terms, token.term) {
+			terms = append(terms, token.term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: no words to search for", ErrInvalidQuery)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	idx, ok := c.tenants[tenant]
+	if !ok {
+		return nil, nil
+	}
+
+	// The rarest word first: it has the fewest files to check, and it makes the best snippet
+	slices.SortFunc(terms, func(a, b string) int {
+		return len(idx.postings[a]) - len(idx.postings[b])
+	})
+
+	var matches []TextMatch
+	for name := range idx.postings[terms[0]] {
+		relative, ok := strings.CutPrefix(name, fullPrefix)
+		if !ok || (keep != nil && !keep(relative)) {
+			continue
+		}
+		doc := idx.docs[name]
+
+		// tf-idf, with a dampened term frequency
+		score := 0.0
+		for _, term := range terms {
+			offsets := doc.terms[term]
+			if len(offsets) == 0 {
+				score = -1
+				break
+			}
+			idf := math.Log(1 + float64(len(idx.docs))/float64(len(idx.postings[term])))
+			score += (1 + math.Log(float64(len(offsets)))) * idf
+		}
+		if score < 0 {
+			continue
+		}
+
+		snippet, highlights := doc.snippet(doc.terms[terms[0]][0], terms)
+		matches = append(matches, TextMatch{
+			Name:       relative,
+			Score:      score,
+			Snippet:    snippet,
+			Highlights: highlights,
+		})
+	}
+
+	slices.SortFunc(matches, func(a, b TextMatch) int {
+		if result := cmp.Compare(b.Score, a.Score); result != 0 {
+			return result
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// About snippetLength bytes of text around the offset, cut at spaces, on one line
+func (d *textDocument) snippet(offset int, terms []string) (string, [][2]int) {
+	start := max(0, offset-snippetLength/3)
+	end := min(len(d.text), start+snippetLength)
+
+	// Don't cut words (or runes) in half
+	if start > 0 {
+		if i := strings.IndexAny(d.text[start:offset], " \t\r\n"); i >= 0 {
+			start += i + 1
+		}
+		for start < offset && !utf8.RuneStart(d.text[start]) {
+			start++
+		}
+	}
+	if end < len(d.text) {
+		if i := strings.LastIndexAny(d.text[offset:end], " \t\r\n"); i > 0 {
+			end = offset + i
+		}
+		for end < len(d.text) && !utf8.RuneStart(d.text[end]) {
+			end++
+		}
+	}
+
+	snippet := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == '\t' {
+			return ' '
+		}
+		return r
+	}, d.text[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(d.text) {
+		snippet += "…"
+	}
+
+	var highlights [][2]int
+	for _, token := range tokenize(snippet) {
+		if slices.Contains(terms, token.term) {
+			highlights = append(highlights, [2]int{token.start, token.end})
+		}
+	}
+	return snippet, highlights
+}
@@ -0,0 +1,312 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A ContentIndex that reads from a map instead of the bucket
+func newTestContentIndex(files map[string]string) *ContentIndex {
+	c := NewContentIndex(NewStore(nil, "bucket", "base"))
+	c.read = func(_ context.Context, objectName string) ([]byte, error) {
+		contents, ok := files[objectName]
+		if !ok {
+			return nil, fmt.Errorf("no such file %s", objectName)
+		}
+		return []byte(contents), nil
+	}
+	return c
+}
+
+func matchNames(matches []TextMatch) []string {
+	names := make([]string, len(matches))
+	for i, match := range matches {
+		names[i] = match.Name
+	}
+	return names
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{`{"name": "Ünïcode", "id": 42}`, []string{"name", "ünïcode", "id", "42"}},
+		{"a,b,cd,efg", []string{"cd", "efg"}},
+		{"# Title\n\n- item_one", []string{"title", "item", "one"}},
+		{strings.Repeat("x", maxTermLength+1) + " ok", []string{"ok"}},
+	}
+
+	for i, test := range tests {
+		var terms []string
+		for _, token := range tokenize(test.text) {
+			terms = append(terms, token.term)
+			if !strings.EqualFold(test.text[token.start:token.end], token.term) {
+				t.Errorf("tokenize(%d): %q is at the wrong offset", i, token.term)
+			}
+		}
+		if !slices.Equal(terms, test.expected) {
+			t.Errorf("tokenize(%d): expected %q, got %q", i, test.expected, terms)
+		}
+	}
+}
+
+func TestContentIndex(t *testing.T) {
+	files := map[string]string{
+		"base/notes/budget.md":         "# Budget 2026\n\nThe marketing budget goes up. The budget for travel goes down.",
+		"base/notes/meeting.txt":       "Discussed the marketing plan and the hiring plan.",
+		"base/data/people.csv":         "name,team\nAda,marketing\nGrace,engineering",
+		"base/data/config.json":        `{"team": "engineering", "budget": 1200}`,
+		"base/photo.jpg":               "marketing budget",
+		"base/tenant/acme/secret.txt":  "acme's marketing budget",
+		"base/tenant/acme/archive.txt": "old budget",
+	}
+	c := newTestContentIndex(files)
+	ctx := context.Background()
+
+	for name, contents := range files {
+		event := Event{Type: EventObjectCreated, Bucket: "bucket", Name: name, Size: int64(len(contents))}
+		if err := c.Apply(ctx, event); err != nil {
+			t.Fatalf("Failed to apply %s: %v", name, err)
+		}
+	}
+
+	search := func(tenant, prefix, query string) []TextMatch {
+		t.Helper()
+		matches, err := c.Search(tenant, prefix, query, 0)
+		if err != nil {
+			t.Fatalf("Search(%q, %q, %q): unexpected error: %v", tenant, prefix, query, err)
+		}
+		return matches
+	}
+
+	tests := []struct {
+		tenant   string
+		prefix   string
+		query    string
+		expected []string
+	}{
+		// budget.md says it three times, config.json once
+		{"", "", "Budget", []string{"notes/budget.md", "data/config.json"}},
+		{"", "", "marketing budget", []string{"notes/budget.md"}},
+		{"", "", "engineering", []string{"data/config.json", "data/people.csv"}},
+		{"", "notes", "marketing", []string{"budget.md", "meeting.txt"}},
+		{"", "", "nothing", nil},
+		{"", "", "budgets", nil},
+		{"acme", "", "budget", []string{"archive.txt", "secret.txt"}},
+		{"globex", "", "budget", nil},
+	}
+
+	for _, test := range tests {
+		matches := search(test.tenant, test.prefix, test.query)
+		if names := matchNames(matches); !slices.Equal(names, test.expected) {
+			t.Errorf("Search(%q, %q, %q): expected %q, got %q", test.tenant, test.prefix, test.query, test.expected, names)
+		}
+	}
+
+	t.Run("Snippets", func(t *testing.T) {
+		matches := search("", "notes", "hiring")
+		if len(matches) != 1 {
+			t.Fatalf("Expected a single match, got %q", matchNames(matches))
+		}
+		match := matches[0]
+		if match.Snippet != "Discussed the marketing plan and the hiring plan." {
+			t.Errorf("Unexpected snippet %q", match.Snippet)
+		}
+		if len(match.Highlights) != 1 || match.Snippet[match.Highlights[0][0]:match.Highlights[0][1]] != "hiring" {
+			t.Errorf("Expected %q to be highlighted, got %v", "hiring", match.Highlights)
+		}
+
+		// Long files get cut around the match, on one line
+		long := strings.Repeat("lorem ipsum dolor ", 50) + "\nthe needle\n" + strings.Repeat("sit amet ", 50)
+		c.add("base/long.txt", newTextDocument(long))
+		matches = search("", "", "needle")
+		snippet := matches[0].Snippet
+		if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") || strings.Contains(snippet, "\n") {
+			t.Errorf("Expected a cut snippet on one line, got %q", snippet)
+		}
+		if len(snippet) > snippetLength+2*len("…") {
+			t.Errorf("Snippet is too long: %d bytes", len(snippet))
+		}
+		if h := matches[0].Highlights; len(h) != 1 || snippet[h[0][0]:h[0][1]] != "needle" {
+			t.Errorf("Expected %q to be highlighted, got %v in %q", "needle", h, snippet)
+		}
+	})
+
+	t.Run("Renames and deletes", func(t *testing.T) {
+		events := []Event{
+			{Type: EventObjectRenamed, Bucket: "bucket", OldName: "base/notes/meeting.txt", Name: "base/notes/minutes.md"},
+			{Type: EventObjectDeleted, Bucket: "bucket", Name: "base/notes/budget.md"},
+			{Type: EventObjectRenamed, Bucket: "bucket", OldName: "base/data/people.csv", Name: "base/data/people.bin"},
+		}
+		for _, event := range events {
+			if err := c.Apply(ctx, event); err != nil {
+				t.Fatalf("Failed to apply %+v: %v", event, err)
+			}
+		}
+
+		if names := matchNames(search("", "", "marketing")); !slices.Equal(names, []string{"notes/minutes.md"}) {
+			t.Errorf("Expected only the renamed file, got %q", names)
+		}
+	})
+
+	t.Run("Invalid queries", func(t *testing.T) {
+		if _, err := c.Search("", "", "a, !", 0); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("Expected an invalid query, got %v", err)
+		}
+		if _, err := c.Search("../acme", "", "budget", 0); !errors.Is(err, ErrInvalidTenant) {
+			t.Errorf("Expected an invalid tenant, got %v", err)
+		}
+		if _, err := c.Search("", "../..", "budget", 0); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected an invalid path, got %v", err)
+		}
+	})
+}
+
+func TestGuardedContentSearch(t *testing.T) {
+	files := map[string]string{
+		"base/shared/alice/plan.md":    "the launch budget",
+		"base/shared/bob/plan.md":      "bob's launch budget",
+		"base/private/salaries.csv":    "budget,amount",
+		"base/tenant/acme/launch.txt":  "acme's launch budget",
+		"base/tenant/acme/private.txt": "acme's secret budget",
+	}
+	c := newTestContentIndex(files)
+	ctx := context.Background()
+	for name, contents := range files {
+		event := Event{Type: EventObjectCreated, Bucket: "bucket", Name: name, Size: int64(len(contents))}
+		if err := c.Apply(ctx, event); err != nil {
+			t.Fatalf("Failed to apply %s: %v", name, err)
+		}
+	}
+
+	p := NewPolicy()
+	p.Grant("alice", "shared/alice", PermissionRead)
+	p.Grant("bob", "", PermissionRead)
+	p.Grant("carol", "launch.txt", PermissionRead)
+	g := NewGuardedStore(c.Store, p)
+
+	alice := WithPrincipal(ctx, "alice")
+	bob := WithPrincipal(ctx, "bob")
+	carol := WithPrincipal(ctx, "carol")
+
+	tests := []struct {
+		ctx      context.Context
+		prefix   string
+		expected []string
+	}{
+		{alice, "", []string{"shared/alice/plan.md"}},
+		{alice, "shared", []string{"alice/plan.md"}},
+		{bob, "", []string{"private/salaries.csv", "shared/alice/plan.md", "shared/bob/plan.md"}},
+	}
+	for _, test := range tests {
+		principal, _ := PrincipalFromContext(test.ctx)
+		matches, err := g.SearchContent(test.ctx, c, test.prefix, "budget", 0)
+		if err != nil {
+			t.Fatalf("SearchContent(%s, %q): unexpected error: %v", principal, test.prefix, err)
+		}
+		names := matchNames(matches)
+		slices.Sort(names)
+		if !slices.Equal(names, test.expected) {
+			t.Errorf("SearchContent(%s, %q): expected %q, got %q", principal, test.prefix, test.expected, names)
+		}
+	}
+
+	if _, err := g.SearchContent(alice, c, "private", "budget", 0); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected a permission denied error, got %v", err)
+	}
+	if _, err := g.SearchContent(ctx, c, "", "budget", 0); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected a missing principal to be denied, got %v", err)
+	}
+
+	t.Run("Tenant stores search their own index", func(t *testing.T) {
+		acme, err := c.Store.ForTenant("acme")
+		if err != nil {
+			t.Fatalf("Failed to scope the store: %v", err)
+		}
+		g := NewGuardedStore(acme, p)
+
+		matches, err := g.SearchContent(carol, c, "", "budget", 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if names := matchNames(matches); !slices.Equal(names, []string{"launch.txt"}) {
+			t.Errorf("Expected only the file carol can read, got %q", names)
+		}
+	})
+
+	t.Run("The index has to cover the guarded store", func(t *testing.T) {
+		g := NewGuardedStore(NewStore(nil, "bucket", "other"), p)
+		if _, err := g.SearchContent(bob, c, "", "budget", 0); !errors.Is(err, ErrStoreMismatch) {
+			t.Errorf("Expected a store mismatch, got %v", err)
+		}
+	})
+}
+
+func TestContentIndexSkipsLargeAndBinaryFiles(t *testing.T) {
+	files := map[string]string{
+		"base/big.txt":                        strings.Repeat("word ", 100),
+		"base/lies.txt":                       strings.Repeat("word ", 100), // Says it's small
+		"base/image.png":                      "word",
+		"base/" + compositeTempDir + "/p.txt": "word",
+		"base/small.TXT":                      "word",
+	}
+	c := newTestContentIndex(files)
+	c.MaxFileSize = 100
+
+	if err := c.backfill(context.Background(), fakeSource{names: []string{"base/image.png", "base/" + compositeTempDir + "/p.txt", "base/small.TXT"}}); err != nil {
+		t.Fatalf("Failed to backfill: %v", err)
+	}
+	if err := c.IndexObject(context.Background(), "base/big.txt", 500); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+	if err := c.IndexObject(context.Background(), "base/lies.txt", 10); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+
+	matches, _ := c.Search("", "", "word", 0)
+	if names := matchNames(matches); !slices.Equal(names, []string{"small.TXT"}) {
+		t.Errorf("Expected only %q, got %q", "small.TXT", names)
+	}
+}
+
+func TestContentIndexSync(t *testing.T) {
+	h := NewTestHelper(t)
+	opts := DefaultStoreOptions()
+	opts.Events = NewEventBus()
+	s := NewStoreWithOptions(h.Client, h.BucketName, h.TestPrefix, opts)
+
+	c := NewContentIndex(s)
+	stop := c.Sync(func(event Event, err error) { t.Errorf("Failed to index %s: %v", event.Name, err) })
+	defer stop()
+
+	const contents = "# Launch plan\n\nShip the rocket on Tuesday."
+	if _, err := s.UploadFile(h.Context, bytes.NewReader([]byte(contents)), "docs", "plan.md"); err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		matches, err := c.Search("", "", "rocket tuesday", 0)
+		if err != nil {
+			t.Fatalf("Failed to search: %v", err)
+		}
+		if len(matches) == 1 {
+			if matches[0].Name != "docs/plan.md" {
+				t.Errorf("Expected %q, got %q", "docs/plan.md", matches[0].Name)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The upload never got indexed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
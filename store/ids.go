@@ -0,0 +1,34 @@
+package store
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// ===================================
+// IDS
+// ===================================
+//
+// Upload ids and event ids are ULIDs, so they sort by time.
+// A fresh math/rand source per call would hand out the same id to two calls
+// in the same nanosecond, so instead we share a single monotonic source:
+// within the same millisecond it increments the random part
+// https://pkg.go.dev/github.com/oklog/ulid/v2#Monotonic
+
+var (
+	ulidMu      sync.Mutex
+	ulidEntropy = ulid.Monotonic(rand.Reader, 0)
+)
+
+// Returns a new lower case ULID, unique within this process
+func newDefaultULID() string {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	id := ulid.MustNew(ulid.Timestamp(time.Now()), ulidEntropy)
+	return strings.ToLower(id.String())
+}
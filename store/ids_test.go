@@ -0,0 +1,32 @@
+package store
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNewDefaultULIDUnique(t *testing.T) {
+	const workers, perWorker = 8, 1000
+
+	var mu sync.Mutex
+	seen := make(map[string]bool, workers*perWorker)
+
+	// Many ids get created within the same millisecond, and at the same time
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				id := newDefaultULID()
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("newDefaultULID handed out %s twice", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
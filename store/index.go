@@ -0,0 +1,564 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// METADATA INDEX
+// ===================================
+//
+// Listing and searching straight from GCS gets slow with millions of objects.
+// The Index is a copy of the metadata of every object under the BasePrefix,
+// in a local BoltDB file, which answers listings, searches and folder sizes
+// without a single request to GCS.
+//
+// It's optional and it's only a cache, GCS stays the source of truth:
+// 1) Sync applies the Store's events as they happen, which covers our own
+// mutations, and the GCS notifications when a NotificationHandler feeds the
+// same EventBus
+// 2) Events can get dropped (see EventBus) and other tools write to the bucket
+// too, so Sync also reconciles the index with a full listing every so often
+//
+// Keys are the full object names, so a prefix is a contiguous range and the
+// queries go through the same code as the GCS listings (see objectSource).
+
+const (
+	DefaultIndexReconcileInterval = time.Hour
+
+	indexQueueSize     = 1024
+	indexReconcileSize = 1000
+	indexPageSize      = 1000
+)
+
+var indexBucket = []byte("objects")
+
+type Index struct {
+	Store *Store
+
+	db   *bolt.DB
+	root string // The full prefix of the BasePrefix, everything we index is under it
+	now  func() time.Time
+}
+
+// What we keep about each object. Directories are their placeholder objects
+type indexEntry struct {
+	Size        int64             `json:"s,omitempty"`
+	Created     time.Time         `json:"c,omitzero"`
+	Updated     time.Time         `json:"u,omitzero"`
+	Generation  int64             `json:"g,omitempty"`
+	ContentType string            `json:"t,omitempty"`
+	Metadata    map[string]string `json:"m,omitempty"` // The custom metadata, tags included
+}
+
+// What a reconciliation changed
+type IndexReconcileStats struct {
+	Scanned int
+	Added   int
+	Updated int
+	Removed int
+}
+
+// Opens (or creates) the index of everything under the store's BasePrefix.
+// An empty index answers everything with nothing, call Reconcile or Sync to fill it
+func OpenIndex(s *Store, file string) (*Index, error) {
+	root, err := s.directoryPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(file, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(indexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+
+	return &Index{Store: s, db: db, root: root, now: time.Now}, nil
+}
+
+func (idx *Index) Close() error {
+	return idx.db.Close()
+}
+
+// ===================================
+// QUERIES
+// ===================================
+//
+// These don't check any permissions. To answer a principal, set the
+// Index of a GuardedStore and go through that
+
+// Same as Store.ListPaginatedObjects
+func (idx *Index) ListPaginatedObjects(
+	ctx context.Context,
+	prefix, startAfter string,
+	limit int,
+	opts ...PageOption,
+) (
+	objects []ObjectInfo,
+	lastObjectName string,
+	hasMore bool,
+	err error,
+) {
+	fullPrefix, err := idx.Store.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return idx.Store.paginate(ctx, idx, fullPrefix, startAfter, limit, nil, opts...)
+}
+
+// Same as Store.ListObjects, the cursors work with either
+func (idx *Index) ListObjects(
+	ctx context.Context,
+	prefix string,
+	opts ListOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	fullPrefix, err := idx.Store.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, "", false, err
+	}
+
+	entries, err := idx.Store.listDirectory(ctx, idx, fullPrefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return opts.page(entries)
+}
+
+// Same as Store.SearchObjects. A scan of the index is cheap, so the cap
+// can be a lot higher than with GCS
+func (idx *Index) SearchObjects(
+	ctx context.Context,
+	prefix, query string,
+	opts SearchOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	fullPrefix, err := idx.Store.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return idx.Store.search(ctx, idx, fullPrefix, query, opts, nil)
+}
+
+// The number of files and their total size under the prefix, recursively.
+// Directory placeholders don't count
+func (idx *Index) FolderSize(prefix string) (QuotaUsage, error) {
+	fullPrefix, err := idx.Store.directoryPath(prefix)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return idx.folderSize(fullPrefix)
+}
+
+func (idx *Index) folderSize(fullPrefix string) (QuotaUsage, error) {
+	var usage QuotaUsage
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexBucket).Cursor()
+		for k, v := c.Seek([]byte(fullPrefix)); k != nil && bytes.HasPrefix(k, []byte(fullPrefix)); k, v = c.Next() {
+			if bytes.HasSuffix(k, []byte("/")) {
+				continue
+			}
+			var entry indexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("corrupt index entry %s: %w", k, err)
+			}
+			usage.Bytes += entry.Size
+			usage.Objects++
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// Lists the index the way GCS lists the bucket, see pagination.go
+func (idx *Index) Objects(ctx context.Context, q *storage.Query) objectIterator {
+	it := &indexIterator{}
+	start := max(q.StartOffset, q.Prefix)
+
+	fetch := func(pageSize int, token string) (string, error) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if pageSize <= 0 {
+			pageSize = indexPageSize
+		}
+		if token != "" {
+			start = token
+		}
+
+		next := ""
+		err := idx.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(indexBucket).Cursor()
+			k, v := c.Seek([]byte(start))
+			for k != nil && strings.HasPrefix(string(k), q.Prefix) {
+				name := string(k)
+				if len(it.items) == pageSize {
+					next = name
+					return nil
+				}
+
+				rest := strings.TrimPrefix(name, q.Prefix)
+				if i := strings.Index(rest, q.Delimiter); q.Delimiter != "" && i >= 0 {
+					// The whole subdirectory is a single prefix, skip to what comes after it
+					prefix := q.Prefix + rest[:i+len(q.Delimiter)]
+					it.items = append(it.items, &storage.ObjectAttrs{Prefix: prefix})
+					after := prefixSuccessor(prefix)
+					if after == "" {
+						return nil
+					}
+					k, v = c.Seek([]byte(after))
+					continue
+				}
+
+				var entry indexEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					return fmt.Errorf("corrupt index entry %s: %w", name, err)
+				}
+				it.items = append(it.items, entry.attrs(idx.Store.BucketName, name))
+				k, v = c.Next()
+			}
+			return nil
+		})
+		return next, err
+	}
+
+	it.pageInfo, it.nextFunc = iterator.NewPageInfo(
+		fetch,
+		func() int { return len(it.items) },
+		func() any { b := it.items; it.items = nil; return b })
+	return it
+}
+
+type indexIterator struct {
+	items    []*storage.ObjectAttrs
+	pageInfo *iterator.PageInfo
+	nextFunc func() error
+}
+
+func (it *indexIterator) Next() (*storage.ObjectAttrs, error) {
+	if err := it.nextFunc(); err != nil {
+		return nil, err
+	}
+	attrs := it.items[0]
+	it.items = it.items[1:]
+	return attrs, nil
+}
+
+func (it *indexIterator) PageInfo() *iterator.PageInfo {
+	return it.pageInfo
+}
+
+func (e indexEntry) attrs(bucket, name string) *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{
+		Bucket:      bucket,
+		Name:        name,
+		Size:        e.Size,
+		Created:     e.Created,
+		Updated:     e.Updated,
+		Generation:  e.Generation,
+		ContentType: e.ContentType,
+		Metadata:    e.Metadata,
+	}
+}
+
+// ===================================
+// KEEPING IT UP TO DATE
+// ===================================
+
+// Applies the Store's events as they come in (when it has an EventBus), and
+// reconciles with the bucket right away and then every interval.
+// Call the returned function to stop
+func (idx *Index) Sync(interval time.Duration, onError func(error)) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultIndexReconcileInterval
+	}
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	unsubscribe := func() {}
+	if idx.Store.Events != nil {
+		var events <-chan Event
+		events, unsubscribe = idx.Store.Events.Subscribe(indexQueueSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range events {
+				report(idx.Apply(event))
+			}
+		}()
+	}
+
+	// In its own goroutine, so that events keep flowing during a reconciliation
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := idx.Reconcile(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			report(err)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+// Updates the index with a single event. Events about other buckets or
+// outside the BasePrefix are ignored.
+// An event never replaces a newer generation, since the events can come out
+// of order (GCS notifications do)
+func (idx *Index) Apply(event Event) error {
+	if event.Bucket != "" && event.Bucket != idx.Store.BucketName {
+		return nil
+	}
+
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+
+		switch event.Type {
+		case EventObjectCreated, EventDirectoryCreated:
+			return idx.put(b, event.Name, eventIndexEntry(event))
+		case EventObjectUpdated:
+			// Same object, so it keeps its creation time
+			entry := eventIndexEntry(event)
+			if current, ok := lookupIndexEntry(b, event.Name); ok && current.Generation == entry.Generation {
+				entry.Created = current.Created
+			}
+			return idx.put(b, event.Name, entry)
+		case EventObjectRenamed:
+			if err := idx.remove(b, event.OldName, 0); err != nil {
+				return err
+			}
+			return idx.put(b, event.Name, eventIndexEntry(event))
+		case EventObjectDeleted:
+			return idx.remove(b, event.Name, event.Generation)
+		}
+		return nil
+	})
+}
+
+func eventIndexEntry(event Event) indexEntry {
+	return indexEntry{
+		Size:        event.Size,
+		Created:     event.Time,
+		Updated:     event.Time,
+		Generation:  event.Generation,
+		ContentType: event.ContentType,
+		Metadata:    event.Metadata,
+	}
+}
+
+func (idx *Index) put(b *bolt.Bucket, name string, entry indexEntry) error {
+	if !idx.indexed(name) {
+		return nil
+	}
+	if current, ok := lookupIndexEntry(b, name); ok && entry.Generation != 0 && current.Generation > entry.Generation {
+		return nil
+	}
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), value)
+}
+
+// Leaves newer generations alone. 0 removes whatever is there
+func (idx *Index) remove(b *bolt.Bucket, name string, generation int64) error {
+	if current, ok := lookupIndexEntry(b, name); ok && generation != 0 && current.Generation > generation {
+		return nil
+	}
+	return b.Delete([]byte(name))
+}
+
+func lookupIndexEntry(b *bolt.Bucket, name string) (indexEntry, bool) {
+	var entry indexEntry
+	value := b.Get([]byte(name))
+	if value == nil || json.Unmarshal(value, &entry) != nil {
+		return indexEntry{}, false
+	}
+	return entry, true
+}
+
+// Our temporary parts (see composite.go) are gone soon, no point in keeping them
+func (idx *Index) indexed(name string) bool {
+	return strings.HasPrefix(name, idx.root) && name != idx.root &&
+		!isCompositePart(idx.Store.BasePrefix, name)
+}
+
+// Makes the index match the bucket: adds what's missing, updates what
+// changed and removes what's gone.
+// Events applied while we list win: we never replace a newer generation,
+// nor remove anything that changed after the listing started. What we
+// miss that way, the next reconcile sorts out.
+func (idx *Index) Reconcile(ctx context.Context) (IndexReconcileStats, error) {
+	return idx.reconcile(ctx, idx.Store.objectSource())
+}
+
+// The listing is sorted, so we go through it in batches and make each range
+// of the index match the batch that covers it
+func (idx *Index) reconcile(ctx context.Context, src objectSource) (stats IndexReconcileStats, err error) {
+	q := &storage.Query{Prefix: idx.root}
+	if err := q.SetAttrSelection([]string{"Name", "Size", "Created", "Updated", "Generation", "ContentType", "Metadata"}); err != nil {
+		return stats, err
+	}
+	started := idx.now()
+
+	from := idx.root // Everything before this is done
+	batch := make([]*storage.ObjectAttrs, 0, indexReconcileSize)
+	it := src.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		done := err == iterator.Done
+		if err != nil && !done {
+			return stats, fmt.Errorf("failed to list objects: %w", err)
+		}
+		if !done {
+			stats.Scanned++
+			if idx.indexed(attrs.Name) {
+				batch = append(batch, attrs)
+			}
+		}
+		if !done && len(batch) < indexReconcileSize {
+			continue
+		}
+
+		// The last batch covers everything up to the end of the prefix
+		until := ""
+		if !done {
+			until = batch[len(batch)-1].Name
+		}
+		if err := idx.reconcileRange(from, until, started, batch, &stats); err != nil {
+			return stats, err
+		}
+		if done {
+			return stats, nil
+		}
+		from = until + "\x00"
+		batch = batch[:0]
+	}
+}
+
+// started is when the listing started, anything that changed after that
+// is newer than the batch
+func (idx *Index) reconcileRange(
+	from, until string,
+	started time.Time,
+	batch []*storage.ObjectAttrs,
+	stats *IndexReconcileStats,
+) error {
+	listed := make(map[string]bool, len(batch))
+	for _, attrs := range batch {
+		listed[attrs.Name] = true
+	}
+
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+
+		// Collected first, deleting while walking a cursor skips entries
+		var gone [][]byte
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil && strings.HasPrefix(string(k), idx.root); k, v = c.Next() {
+			if until != "" && string(k) > until {
+				break
+			}
+			if listed[string(k)] {
+				continue
+			}
+			var entry indexEntry
+			if json.Unmarshal(v, &entry) == nil && entry.Updated.After(started) {
+				// Created by an event while we were listing
+				continue
+			}
+			gone = append(gone, bytes.Clone(k))
+		}
+		for _, k := range gone {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			stats.Removed++
+		}
+
+		for _, attrs := range batch {
+			if current, ok := lookupIndexEntry(b, attrs.Name); ok && current.Generation > attrs.Generation {
+				// An event got there first
+				continue
+			}
+			value, err := json.Marshal(indexEntry{
+				Size:        attrs.Size,
+				Created:     attrs.Created,
+				Updated:     attrs.Updated,
+				Generation:  attrs.Generation,
+				ContentType: attrs.ContentType,
+				Metadata:    attrs.Metadata,
+			})
+			if err != nil {
+				return err
+			}
+
+			current := b.Get([]byte(attrs.Name))
+			if bytes.Equal(current, value) {
+				continue
+			}
+			if current == nil {
+				stats.Added++
+			} else {
+				stats.Updated++
+			}
+			if err := b.Put([]byte(attrs.Name), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestIndex(t *testing.T, s *Store) *Index {
+	t.Helper()
+	idx, err := OpenIndex(s, filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return idx
+}
+
+func TestIndexListsLikeTheBucket(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	rng := rand.New(rand.NewPCG(4, 5))
+	// A nested .composite is a user directory like any other
+	segments := []string{"a", "b", "a-b", "a.b", "a b", "a0", compositeTempDir}
+
+	for tree := range 20 {
+		var names []string
+		for range 1 + rng.IntN(40) {
+			parts := []string{"base"}
+			for range 1 + rng.IntN(3) {
+				parts = append(parts, segments[rng.IntN(len(segments))])
+			}
+			name := strings.Join(parts, "/")
+			if rng.IntN(4) == 0 {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		// Not ours, or temporary, never indexed
+		names = append(names, "other/a.txt", "base0/a.txt", "base/"+compositeTempDir+"/01J/part-1")
+		src := fakeSource{names: names}
+
+		idx := openTestIndex(t, s)
+		if _, err := idx.reconcile(context.Background(), src); err != nil {
+			t.Fatalf("Failed to reconcile: %v", err)
+		}
+
+		for _, fullPrefix := range []string{"base/", "base/a/", "base/a-b/"} {
+			for limit := 1; limit <= 10; limit++ {
+				expected := pageThrough(t, s, src, fullPrefix, limit, nil)
+				if result := pageThrough(t, s, idx, fullPrefix, limit, nil); !slices.Equal(result, expected) {
+					t.Fatalf("tree %d, %q, limit %d: expected %q, got %q\nfrom %q", tree, fullPrefix, limit, expected, result, names)
+				}
+			}
+		}
+
+		expected, _, _, _ := s.search(context.Background(), src, "base/", "a", SearchOptions{}, nil)
+		result, _, _, err := idx.SearchObjects(context.Background(), "", "a", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Failed to search: %v", err)
+		}
+		if !slices.Equal(listNames(result), listNames(expected)) {
+			t.Fatalf("tree %d: expected %q, got %q", tree, listNames(expected), listNames(result))
+		}
+	}
+}
+
+func TestIndexReconcile(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	idx := openTestIndex(t, s)
+	ctx := context.Background()
+
+	stats, err := idx.reconcile(ctx, fakeSource{names: []string{"base/a.txt", "base/b.txt", "base/docs/c.txt"}})
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if stats != (IndexReconcileStats{Scanned: 3, Added: 3}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// b.txt is gone and d.txt is new, the rest didn't change
+	stats, err = idx.reconcile(ctx, fakeSource{names: []string{"base/a.txt", "base/d.txt", "base/docs/c.txt"}})
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if stats != (IndexReconcileStats{Scanned: 3, Added: 1, Removed: 1}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	objects, _, _, err := idx.ListObjects(ctx, "", ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if names := listNames(objects); !slices.Equal(names, []string{"a.txt", "d.txt", "docs/"}) {
+		t.Errorf("Expected %q, got %q", []string{"a.txt", "d.txt", "docs/"}, names)
+	}
+
+	// An empty bucket empties the index
+	if _, err := idx.reconcile(ctx, fakeSource{}); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if usage, _ := idx.FolderSize(""); usage.Objects != 0 {
+		t.Errorf("Expected an empty index, got %+v", usage)
+	}
+}
+
+func TestIndexReconcileKeepsNewerEvents(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	idx := openTestIndex(t, s)
+	ctx := context.Background()
+	started := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	idx.now = func() time.Time { return started }
+
+	// Both arrive while the listing is underway, and it saw neither
+	events := []Event{
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "base/a.txt", Size: 200, Generation: 2, Time: started.Add(time.Second)},
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "base/new.txt", Size: 10, Generation: 1, Time: started.Add(time.Second)},
+	}
+	for _, event := range events {
+		if err := idx.Apply(event); err != nil {
+			t.Fatalf("Failed to apply %+v: %v", event, err)
+		}
+	}
+
+	src := fakeSource{names: []string{"base/a.txt"}, generations: map[string]int64{"base/a.txt": 1}}
+	if _, err := idx.reconcile(ctx, src); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+
+	objects, _, _, err := idx.ListObjects(ctx, "", ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if names := listNames(objects); !slices.Equal(names, []string{"a.txt", "new.txt"}) {
+		t.Fatalf("Expected both files to stay, got %q", names)
+	}
+	if objects[0].Size != 200 {
+		t.Errorf("Expected generation 2 of a.txt to stay, got %+v", objects[0])
+	}
+
+	// The next listing does see that new.txt is gone
+	idx.now = func() time.Time { return started.Add(time.Minute) }
+	if _, err := idx.reconcile(ctx, src); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if usage, _ := idx.FolderSize(""); usage.Objects != 1 {
+		t.Errorf("Expected new.txt to be removed, got %+v", usage)
+	}
+}
+
+func TestIndexKeepsTags(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	idx := openTestIndex(t, s)
+	ctx := context.Background()
+
+	src := fakeSource{
+		names:    []string{"base/a.txt", "base/b.txt"},
+		metadata: map[string]map[string]string{"base/a.txt": {tagsMetadataKey: "invoice,urgent"}},
+	}
+	if _, err := idx.reconcile(ctx, src); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	event := Event{Type: EventObjectCreated, Bucket: "bucket", Name: "base/c.txt", Generation: 1, Metadata: map[string]string{tagsMetadataKey: "invoice"}}
+	if err := idx.Apply(event); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+
+	objects, _, _, err := idx.ListObjects(ctx, "", ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if !slices.Equal(objects[0].Tags, []string{"invoice", "urgent"}) || len(objects[1].Tags) != 0 || !slices.Equal(objects[2].Tags, []string{"invoice"}) {
+		t.Errorf("Expected the tags to be listed, got %+v", objects)
+	}
+
+	// The same as the listing from the bucket
+	expected, _, _, _ := s.listByTag(ctx, src, "base/", "urgent", SearchOptions{}, nil)
+	result, _, _, err := idx.Store.listByTag(ctx, idx, "base/", "urgent", SearchOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to list by tag: %v", err)
+	}
+	if !slices.Equal(listNames(result), listNames(expected)) || len(result) != 1 {
+		t.Errorf("Expected %q, got %q", listNames(expected), listNames(result))
+	}
+
+	t.Run("Tag changes show up without a reconcile", func(t *testing.T) {
+		event := Event{Type: EventObjectUpdated, Bucket: "bucket", Name: "base/b.txt", Time: time.Now(), Metadata: map[string]string{tagsMetadataKey: "urgent"}}
+		if err := idx.Apply(event); err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+
+		result, _, _, err := idx.Store.listByTag(ctx, idx, "base/", "urgent", SearchOptions{}, nil)
+		if err != nil {
+			t.Fatalf("Failed to list by tag: %v", err)
+		}
+		if names := listNames(result); !slices.Equal(names, []string{"a.txt", "b.txt"}) {
+			t.Errorf("Expected a.txt and b.txt, got %q", names)
+		}
+		// Still the same object
+		if !result[1].Created.Equal(objects[1].Created) {
+			t.Errorf("Expected the creation time to be kept, got %v", result[1].Created)
+		}
+	})
+}
+
+func TestGuardedIndex(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	idx := openTestIndex(t, s)
+	ctx := context.Background()
+
+	names := []string{"base/docs/a.txt", "base/docs/b.txt", "base/private/c.txt", "base/tenant/acme/d.txt"}
+	if _, err := idx.reconcile(ctx, fakeSource{names: names}); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+
+	p := NewPolicy()
+	p.Grant("alice", "docs", PermissionRead)
+	g := NewGuardedStore(s, p)
+	g.Index = idx
+	alice := WithPrincipal(ctx, "alice")
+
+	objects, _, _, err := g.ListPaginatedObjects(alice, "", "", 10)
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if names := listNames(objects); !slices.Equal(names, []string{"docs/"}) {
+		t.Errorf("Expected only docs, got %q", names)
+	}
+
+	objects, _, _, err = g.ListObjects(alice, "", ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if names := listNames(objects); !slices.Equal(names, []string{"docs/"}) {
+		t.Errorf("Expected only docs, got %q", names)
+	}
+
+	objects, _, _, err = g.SearchObjects(alice, "", "txt", SearchOptions{})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if names := listNames(objects); !slices.Equal(names, []string{"docs/a.txt", "docs/b.txt"}) {
+		t.Errorf("Expected only the files in docs, got %q", names)
+	}
+
+	if usage, err := g.FolderSize(alice, "docs"); err != nil || usage.Objects != 2 {
+		t.Errorf("Expected 2 objects in docs, got %+v (%v)", usage, err)
+	}
+	if _, err := g.FolderSize(alice, ""); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected the size of the root to be denied, got %v", err)
+	}
+	if _, _, _, err := g.ListPaginatedObjects(ctx, "docs", "", 10); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected a missing principal to be denied, got %v", err)
+	}
+
+	t.Run("Tenant stores use the index of their parent", func(t *testing.T) {
+		acme, _ := s.ForTenant("acme")
+		p := NewPolicy()
+		p.Grant("alice", "", PermissionRead)
+		g := &GuardedStore{Store: acme, Policy: p, Index: idx}
+
+		objects, _, _, err := g.ListPaginatedObjects(alice, "", "", 10)
+		if err != nil {
+			t.Fatalf("Failed to list: %v", err)
+		}
+		if names := listNames(objects); !slices.Equal(names, []string{"d.txt"}) {
+			t.Errorf("Expected only the tenant's file, got %q", names)
+		}
+	})
+
+	t.Run("The index has to cover the guarded store", func(t *testing.T) {
+		g := &GuardedStore{Store: NewStore(nil, "bucket", "other"), Policy: p, Index: idx}
+		if _, _, _, err := g.ListPaginatedObjects(alice, "docs", "", 10); !errors.Is(err, ErrStoreMismatch) {
+			t.Errorf("Expected a store mismatch, got %v", err)
+		}
+	})
+}
+
+func TestIndexApply(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	idx := openTestIndex(t, s)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	events := []Event{
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "base/docs/a.txt", Size: 100, Generation: 1, Time: now},
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "base/docs/b.txt", Size: 50, Generation: 1, Time: now},
+		{Type: EventDirectoryCreated, Bucket: "bucket", Name: "base/docs/empty/", Generation: 1, Time: now},
+		{Type: EventObjectRenamed, Bucket: "bucket", OldName: "base/docs/b.txt", Name: "base/docs/c.txt", Size: 50, Generation: 2, Time: now},
+
+		// Overwritten, then the delete of the old version shows up late
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "base/docs/a.txt", Size: 200, Generation: 3, Time: now},
+		{Type: EventObjectDeleted, Bucket: "bucket", Name: "base/docs/a.txt", Generation: 1, Time: now},
+
+		// None of these are ours
+		{Type: EventObjectCreated, Bucket: "other", Name: "base/docs/x.txt", Size: 1000},
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "elsewhere/x.txt", Size: 1000},
+		{Type: EventObjectCreated, Bucket: "bucket", Name: "base/" + compositeTempDir + "/x.part-1", Size: 1000},
+	}
+	for _, event := range events {
+		if err := idx.Apply(event); err != nil {
+			t.Fatalf("Failed to apply %+v: %v", event, err)
+		}
+	}
+
+	objects, _, _, err := idx.ListObjects(context.Background(), "docs", ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if names := listNames(objects); !slices.Equal(names, []string{"a.txt", "c.txt", "empty/"}) {
+		t.Errorf("Expected %q, got %q", []string{"a.txt", "c.txt", "empty/"}, names)
+	}
+	if objects[0].Size != 200 || !objects[0].Updated.Equal(now) {
+		t.Errorf("Expected the latest version of a.txt, got %+v", objects[0])
+	}
+
+	usage, err := idx.FolderSize("")
+	if err != nil {
+		t.Fatalf("Failed to get the folder size: %v", err)
+	}
+	if usage != (QuotaUsage{Bytes: 250, Objects: 2}) {
+		t.Errorf("Expected 250 bytes in 2 objects, got %+v", usage)
+	}
+
+	if err := idx.Apply(Event{Type: EventObjectDeleted, Bucket: "bucket", Name: "base/docs/a.txt"}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	if usage, _ := idx.FolderSize("docs"); usage != (QuotaUsage{Bytes: 50, Objects: 1}) {
+		t.Errorf("Expected 50 bytes in 1 object, got %+v", usage)
+	}
+}
+
+func TestIndexSync(t *testing.T) {
+	h := NewTestHelper(t)
+	opts := DefaultStoreOptions()
+	opts.Events = NewEventBus()
+	s := NewStoreWithOptions(h.Client, h.BucketName, h.TestPrefix, opts)
+
+	if _, err := s.UploadFile(h.Context, bytes.NewReader([]byte("before")), "docs", "before.txt"); err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	idx := openTestIndex(t, s)
+	stop := idx.Sync(time.Hour, func(err error) { t.Errorf("Sync failed: %v", err) })
+	defer stop()
+
+	// Found by the first reconcile, and then by the event
+	if _, err := s.UploadFile(h.Context, bytes.NewReader([]byte("after")), "docs", "after.txt"); err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	expected := QuotaUsage{Bytes: int64(len("before") + len("after")), Objects: 2}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		usage, err := idx.FolderSize("docs")
+		if err != nil {
+			t.Fatalf("Failed to get the folder size: %v", err)
+		}
+		if usage == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %+v, got %+v", expected, usage)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Tags come through the events too, long before the next reconcile
+	p := NewPolicy()
+	p.Grant("alice", "", PermissionRead)
+	g := NewGuardedStore(s, p)
+	g.Index = idx
+	alice := WithPrincipal(h.Context, "alice")
+
+	if _, err := s.SetTags(h.Context, "docs", "after.txt", []string{"urgent"}); err != nil {
+		t.Fatalf("Failed to set tags: %v", err)
+	}
+	for {
+		objects, _, _, err := g.ListByTag(alice, "", "urgent", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Failed to list by tag: %v", err)
+		}
+		if names := listNames(objects); slices.Equal(names, []string{"docs/after.txt"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the tagged file, got %q", listNames(objects))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// STORAGE CLASSES AND LIFECYCLE
+// ===================================
+//
+// Old files nobody opens cost the same as the ones used every day, unless they
+// move to a colder storage class. Cheaper to keep, more expensive to read:
+// https://cloud.google.com/storage/docs/storage-classes
+//
+// A single file can be moved with SetStorageClass. To do it automatically, the
+// bucket gets lifecycle rules ("move to Coldline after 90 days") and GCS
+// applies them on its own, about once a day:
+// https://cloud.google.com/storage/docs/lifecycle
+//
+// The lifecycle is configured on the bucket, like EnableVersioning, so the
+// prefixes in the rules are full object names, not relative to a BasePrefix.
+//
+// Careful: Nearline, Coldline and Archive have a minimum storage duration
+// (30, 90 and 365 days). Deleting, overwriting or moving a file sooner is
+// still charged for the whole duration.
+
+const (
+	StorageClassStandard = "STANDARD"
+	StorageClassNearline = "NEARLINE"
+	StorageClassColdline = "COLDLINE"
+	StorageClassArchive  = "ARCHIVE"
+)
+
+// GCS refuses buckets with more rules than this
+const MaxLifecycleRules = 100
+
+var (
+	ErrInvalidStorageClass = errors.New("invalid storage class")
+	ErrInvalidLifecycle    = errors.New("invalid lifecycle rule")
+)
+
+var storageClasses = []string{StorageClassStandard, StorageClassNearline, StorageClassColdline, StorageClassArchive}
+
+// What happens to the objects a rule matches
+const (
+	LifecycleDelete          = storage.DeleteAction
+	LifecycleSetStorageClass = storage.SetStorageClassAction
+)
+
+// A simpler storage.LifecycleRule, with the conditions we use.
+// An object has to match every condition that is set, zero means not set
+type LifecycleRule struct {
+	// LifecycleDelete or LifecycleSetStorageClass
+	Action string
+
+	// Where LifecycleSetStorageClass moves the objects to
+	StorageClass string
+
+	// Days since the object was created
+	AgeDays int64
+
+	// Days since the version became noncurrent (see DeleteObject)
+	DaysSinceNoncurrent int64
+
+	// Versions that are newer than this one, the live one included.
+	// Only noncurrent versions have any
+	NumNewerVersions int64
+
+	// storage.Live or storage.Archived (noncurrent) versions only.
+	// The default storage.LiveAndArchived matches both
+	Liveness storage.Liveness
+
+	// The full object name starts with one of these (e.g. "base/tenant/acme/")
+	MatchesPrefix []string
+
+	// The object is currently in one of these storage classes
+	MatchesStorageClasses []string
+}
+
+// Moves a file to another storage class, e.g. StorageClassColdline.
+// GCS can't change the class in place, so the file is rewritten onto itself
+// with every other attribute kept (see copyObject). That makes a new generation,
+// so with versioning the old one stays behind as noncurrent, in the old class
+func (s *Store) SetStorageClass(
+	ctx context.Context,
+	prefix, objectName string,
+	storageClass string,
+) (
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	objectPath, err := s.objectPath(prefix, objectName)
+	defer func() { s.mutated(ctx, OperationSetStorageClass, "", objectPath, attrs, err) }()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(storageClasses, storageClass) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidStorageClass, storageClass)
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	obj := s.getObject(objectPath)
+	srcAttrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set the storage class of %s: %w", objectPath, err)
+	}
+	if srcAttrs.StorageClass == storageClass {
+		return srcAttrs, nil
+	}
+
+	// Both sides pinned to what we read, an upload in between wins
+	pinned := obj.If(storage.Conditions{GenerationMatch: srcAttrs.Generation})
+	copier := newCopier(pinned, pinned, srcAttrs)
+	copier.ObjectAttrs.StorageClass = storageClass
+
+	attrs, err = copier.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set the storage class of %s: %w", objectPath, err)
+	}
+	return attrs, nil
+}
+
+// Replaces the lifecycle rules of the bucket, no rules removes them all.
+// Rules added some other way (console, gcloud) are replaced too
+func SetLifecycle(
+	ctx context.Context,
+	client *storage.Client,
+	bucketName string,
+	rules []LifecycleRule,
+) error {
+	lifecycle, err := toLifecycle(rules)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Bucket(bucketName).Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle})
+	if err != nil {
+		return fmt.Errorf("failed to set the lifecycle of %s: %w", bucketName, err)
+	}
+	return nil
+}
+
+// The lifecycle rules of the bucket.
+// Conditions LifecycleRule doesn't have (e.g. on the custom time) are left out,
+// so don't feed the result of this to SetLifecycle for a bucket managed elsewhere
+func GetLifecycle(
+	ctx context.Context,
+	client *storage.Client,
+	bucketName string,
+) ([]LifecycleRule, error) {
+	attrs, err := client.Bucket(bucketName).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the lifecycle of %s: %w", bucketName, err)
+	}
+	return fromLifecycle(attrs.Lifecycle), nil
+}
+
+func toLifecycle(rules []LifecycleRule) (storage.Lifecycle, error) {
+	if len(rules) > MaxLifecycleRules {
+		return storage.Lifecycle{}, fmt.Errorf("%w: at most %d rules, got %d", ErrInvalidLifecycle, MaxLifecycleRules, len(rules))
+	}
+
+	var lifecycle storage.Lifecycle
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return storage.Lifecycle{}, fmt.Errorf("rule %d: %w", i, err)
+		}
+		lifecycle.Rules = append(lifecycle.Rules, storage.LifecycleRule{
+			Action: storage.LifecycleAction{
+				Type:         rule.Action,
+				StorageClass: rule.StorageClass,
+			},
+			Condition: storage.LifecycleCondition{
+				AgeInDays:               rule.AgeDays,
+				DaysSinceNoncurrentTime: rule.DaysSinceNoncurrent,
+				NumNewerVersions:        rule.NumNewerVersions,
+				Liveness:                rule.Liveness,
+				MatchesPrefix:           rule.MatchesPrefix,
+				MatchesStorageClasses:   rule.MatchesStorageClasses,
+			},
+		})
+	}
+	return lifecycle, nil
+}
+
+func fromLifecycle(lifecycle storage.Lifecycle) []LifecycleRule {
+	var rules []LifecycleRule
+	for _, rule := range lifecycle.Rules {
+		rules = append(rules, LifecycleRule{
+			Action:                rule.Action.Type,
+			StorageClass:          rule.Action.StorageClass,
+			AgeDays:               rule.Condition.AgeInDays,
+			DaysSinceNoncurrent:   rule.Condition.DaysSinceNoncurrentTime,
+			NumNewerVersions:      rule.Condition.NumNewerVersions,
+			Liveness:              rule.Condition.Liveness,
+			MatchesPrefix:         rule.Condition.MatchesPrefix,
+			MatchesStorageClasses: rule.Condition.MatchesStorageClasses,
+		})
+	}
+	return rules
+}
+
+func (r LifecycleRule) validate() error {
+	switch r.Action {
+	case LifecycleDelete:
+		if r.StorageClass != "" {
+			return fmt.Errorf("%w: a delete has no storage class", ErrInvalidLifecycle)
+		}
+	case LifecycleSetStorageClass:
+		// GCS only moves objects to a colder class, never back to Standard
+		if r.StorageClass == StorageClassStandard || !slices.Contains(storageClasses, r.StorageClass) {
+			return fmt.Errorf("%w: can't move objects to %q", ErrInvalidStorageClass, r.StorageClass)
+		}
+	default:
+		return fmt.Errorf("%w: unknown action %q", ErrInvalidLifecycle, r.Action)
+	}
+
+	if r.AgeDays < 0 || r.DaysSinceNoncurrent < 0 || r.NumNewerVersions < 0 {
+		return fmt.Errorf("%w: negative condition", ErrInvalidLifecycle)
+	}
+	if slices.Contains(r.MatchesPrefix, "") {
+		return fmt.Errorf("%w: an empty prefix matches everything", ErrInvalidLifecycle)
+	}
+	for _, class := range r.MatchesStorageClasses {
+		if !slices.Contains(storageClasses, class) {
+			return fmt.Errorf("%w: %q", ErrInvalidStorageClass, class)
+		}
+	}
+
+	// Liveness and storage classes only narrow it down to a whole class of
+	// objects, e.g. every live one. It needs an age, a count or a prefix too,
+	// otherwise it would match (nearly) everything in the bucket
+	if r.AgeDays == 0 && r.DaysSinceNoncurrent == 0 && r.NumNewerVersions == 0 && len(r.MatchesPrefix) == 0 {
+		return fmt.Errorf("%w: no age, count or prefix condition, it would match everything", ErrInvalidLifecycle)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestLifecycleRules(t *testing.T) {
+	tests := []struct {
+		rule  LifecycleRule
+		valid bool
+	}{
+		{LifecycleRule{Action: LifecycleSetStorageClass, StorageClass: StorageClassNearline, AgeDays: 30}, true},
+		{LifecycleRule{Action: LifecycleSetStorageClass, StorageClass: StorageClassColdline, AgeDays: 90, MatchesStorageClasses: []string{StorageClassNearline}}, true},
+		{LifecycleRule{Action: LifecycleDelete, NumNewerVersions: 3}, true},
+		{LifecycleRule{Action: LifecycleDelete, DaysSinceNoncurrent: 30, MatchesPrefix: []string{"base/tenant/acme/"}}, true},
+		{LifecycleRule{Action: LifecycleDelete, NumNewerVersions: 1, Liveness: storage.Archived}, true},
+		{LifecycleRule{Action: LifecycleDelete, Liveness: storage.Live, MatchesPrefix: []string{"base/tmp/"}}, true},
+		{LifecycleRule{Action: LifecycleDelete}, false},
+		// Every live object, every noncurrent version, every Nearline object
+		{LifecycleRule{Action: LifecycleDelete, Liveness: storage.Live}, false},
+		{LifecycleRule{Action: LifecycleDelete, Liveness: storage.Archived}, false},
+		{LifecycleRule{Action: LifecycleDelete, MatchesStorageClasses: []string{StorageClassNearline}}, false},
+		{LifecycleRule{Action: LifecycleDelete, Liveness: storage.Live, MatchesPrefix: []string{""}}, false},
+		{LifecycleRule{Action: LifecycleDelete, StorageClass: StorageClassArchive, AgeDays: 1}, false},
+		{LifecycleRule{Action: LifecycleSetStorageClass, StorageClass: StorageClassStandard, AgeDays: 1}, false},
+		{LifecycleRule{Action: LifecycleSetStorageClass, StorageClass: "FROZEN", AgeDays: 1}, false},
+		{LifecycleRule{Action: LifecycleSetStorageClass, AgeDays: 1}, false},
+		{LifecycleRule{Action: "Archive", AgeDays: 1}, false},
+		{LifecycleRule{Action: LifecycleDelete, AgeDays: -1}, false},
+		{LifecycleRule{Action: LifecycleDelete, AgeDays: 1, MatchesStorageClasses: []string{"nearline"}}, false},
+	}
+
+	for i, test := range tests {
+		lifecycle, err := toLifecycle([]LifecycleRule{test.rule})
+		if !test.valid {
+			if !errors.Is(err, ErrInvalidLifecycle) && !errors.Is(err, ErrInvalidStorageClass) {
+				t.Errorf("LifecycleRule(%d): expected an invalid rule, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LifecycleRule(%d): unexpected error: %v", i, err)
+			continue
+		}
+
+		// What we read back from the bucket is what we set
+		if rules := fromLifecycle(lifecycle); len(rules) != 1 || !reflect.DeepEqual(rules[0], test.rule) {
+			t.Errorf("LifecycleRule(%d): expected %+v back, got %+v", i, test.rule, rules)
+		}
+	}
+
+	t.Run("Too many rules", func(t *testing.T) {
+		rules := make([]LifecycleRule, MaxLifecycleRules+1)
+		for i := range rules {
+			rules[i] = LifecycleRule{Action: LifecycleDelete, AgeDays: int64(i + 1)}
+		}
+		if _, err := toLifecycle(rules); !errors.Is(err, ErrInvalidLifecycle) {
+			t.Errorf("Expected too many rules to be invalid, got %v", err)
+		}
+		if _, err := toLifecycle(rules[:MaxLifecycleRules]); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+// Nearline has a minimum storage duration of 30 days. Deleting the file right
+// after the test is charged as if it was kept that long, on every run.
+// So it only runs when TEST_STORAGE_CLASSES is set
+// https://cloud.google.com/storage/pricing#early-delete
+func TestSetStorageClass(t *testing.T) {
+	if os.Getenv("TEST_STORAGE_CLASSES") == "" {
+		t.Skip("TEST_STORAGE_CLASSES is not set, changing storage classes incurs early deletion charges")
+	}
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+
+	w := h.Client.Bucket(h.BucketName).Object(path.Join(h.TestPrefix, "old.csv")).NewWriter(h.Context)
+	w.ContentType = "text/csv"
+	w.Metadata = map[string]string{"tags": "archive"}
+	if _, err := w.Write([]byte("a,b\n")); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	before := w.Attrs()
+
+	attrs, err := s.SetStorageClass(h.Context, "", "old.csv", StorageClassNearline)
+	if err != nil {
+		t.Fatalf("Failed to set the storage class: %v", err)
+	}
+	if attrs.StorageClass != StorageClassNearline {
+		t.Errorf("Expected %s, got %s", StorageClassNearline, attrs.StorageClass)
+	}
+
+	// Everything else stays the same
+	before.StorageClass = StorageClassNearline
+	if different := differentAttributes(before, attrs); len(different) > 0 {
+		t.Errorf("Setting the storage class lost %v", different)
+	}
+
+	if _, err := s.SetStorageClass(h.Context, "", "old.csv", "nearline"); !errors.Is(err, ErrInvalidStorageClass) {
+		t.Errorf("Expected an invalid storage class, got %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// LISTING WITH OPTIONS
+// ===================================
+//
+// GCS only lists in lexicographic order, but the UI wants "newest first",
+// "largest first" or "only PDFs". There is no way around reading the whole
+// directory (one level, not the subdirectories) for that, so ListObjects does
+// exactly that and then filters, sorts and pages in memory.
+//
+// The pages use keyset pagination: the cursor holds the sort key of the last
+// entry returned, and the next page starts right after it. Unlike an offset,
+// that keeps working when files are added or removed between pages, nothing
+// gets skipped or shown twice.
+
+type SortField string
+
+const (
+	SortByName    SortField = "name"
+	SortBySize    SortField = "size"
+	SortByUpdated SortField = "updated"
+)
+
+const DefaultListLimit = 100
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Zero values mean no filtering. Directories only have a name, so the
+// extension, size and updated filters only ever match files
+type ListOptions struct {
+	SortBy     SortField // Defaults to SortByName
+	Descending bool
+
+	// All the directories before the files, like every file manager does.
+	// Descending doesn't change that, only the order within each group
+	DirectoriesFirst bool
+
+	// Matched against the name (case-insensitive), e.g. "report-*.pdf"
+	// See path.Match for the syntax
+	Glob string
+
+	// With or without the dot, case-insensitive, e.g. "pdf" or ".PDF"
+	Extensions []string
+
+	MinSize int64
+	MaxSize int64
+
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+
+	// Defaults to DefaultListLimit
+	Limit int
+
+	// From the previous page. Empty for the first page.
+	// Only valid with the same prefix and options it came from
+	Cursor string
+}
+
+// Lists a single directory, sorted and filtered.
+// Pass nextCursor in the options to get the next page
+func (s *Store) ListObjects(
+	ctx context.Context,
+	prefix string,
+	opts ListOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	fullPrefix, err := s.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, "", false, err
+	}
+
+	entries, err := s.listDirectory(ctx, s.objectSource(), fullPrefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return opts.page(entries)
+}
+
+// Filters, sorts and picks the page the cursor points at
+func (o ListOptions) page(entries []ObjectInfo) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	after, err := o.decodeCursor()
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	entries = slices.DeleteFunc(entries, func(entry ObjectInfo) bool {
+		return !o.matches(entry)
+	})
+	slices.SortFunc(entries, o.compare)
+
+	// Skip everything up to and including the last entry of the previous page.
+	// That entry may be gone by now, which is fine, we only need to know where it was
+	start := 0
+	if after != nil {
+		start, _ = slices.BinarySearchFunc(entries, *after, o.compare)
+		if start < len(entries) && o.compare(entries[start], *after) == 0 {
+			start++
+		}
+	}
+
+	end := min(start+o.limit(), len(entries))
+	objects = entries[start:end]
+	hasMore = end < len(entries)
+	if hasMore {
+		nextCursor = o.encodeCursor(objects[len(objects)-1])
+	}
+	return objects, nextCursor, hasMore, nil
+}
+
+// Everything directly inside the directory, in the order GCS returns it
+func (s *Store) listDirectory(
+	ctx context.Context,
+	src objectSource,
+	fullPrefix string,
+) ([]ObjectInfo, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var entries []ObjectInfo
+	it := src.Objects(ctx, &storage.Query{
+		Prefix:    fullPrefix,
+		Delimiter: "/",
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error iterating objects: %v", err)
+		}
+		if entry, ok := s.objectInfo(fullPrefix, attrs); ok {
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// Turns what the listing returned into an ObjectInfo relative to the directory.
+// Returns false for things that shouldn't be listed: the directory placeholder
+// itself and our temporary parts (see composite.go)
+func (s *Store) objectInfo(fullPrefix string, attrs *storage.ObjectAttrs) (ObjectInfo, bool) {
+	if attrs.Prefix != "" {
+		name := strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, fullPrefix), "/")
+		if name == "" || isCompositePart(s.BasePrefix, attrs.Prefix) {
+			return ObjectInfo{}, false
+		}
+		return ObjectInfo{
+			Name:  name,
+			IsDir: true,
+		}, true
+	}
+
+	name := strings.TrimPrefix(attrs.Name, fullPrefix)
+	if name == "" {
+		return ObjectInfo{}, false
+	}
+	return ObjectInfo{
+		Name:              name,
+		Size:              attrs.Size,
+		HumanReadableSize: FormatBytes(attrs.Size),
+		Created:           attrs.Created,
+		Updated:           attrs.Updated,
+		Tags:              tagsFromMetadata(attrs.Metadata),
+	}, true
+}
+
+func (o ListOptions) validate() error {
+	switch o.SortBy {
+	case "", SortByName, SortBySize, SortByUpdated:
+	default:
+		return fmt.Errorf("unknown sort field %q", o.SortBy)
+	}
+	if o.Glob != "" {
+		if _, err := path.Match(o.Glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", o.Glob, err)
+		}
+	}
+	if o.MaxSize > 0 && o.MinSize > o.MaxSize {
+		return fmt.Errorf("min size %d is larger than max size %d", o.MinSize, o.MaxSize)
+	}
+	return nil
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return o.Limit
+}
+
+func (o ListOptions) sortBy() SortField {
+	if o.SortBy == "" {
+		return SortByName
+	}
+	return o.SortBy
+}
+
+func (o ListOptions) matches(entry ObjectInfo) bool {
+	if o.Glob != "" {
+		if ok, _ := path.Match(strings.ToLower(o.Glob), strings.ToLower(entry.Name)); !ok {
+			return false
+		}
+	}
+
+	filtersFiles := len(o.Extensions) > 0 || o.MinSize > 0 || o.MaxSize > 0 ||
+		!o.UpdatedAfter.IsZero() || !o.UpdatedBefore.IsZero()
+	if !filtersFiles {
+		return true
+	}
+	if entry.IsDir {
+		return false
+	}
+
+	if len(o.Extensions) > 0 && !slices.ContainsFunc(o.Extensions, func(ext string) bool {
+		return strings.EqualFold(path.Ext(entry.Name), "."+strings.TrimPrefix(ext, "."))
+	}) {
+		return false
+	}
+	if entry.Size < o.MinSize || (o.MaxSize > 0 && entry.Size > o.MaxSize) {
+		return false
+	}
+	if !o.UpdatedAfter.IsZero() && !entry.Updated.After(o.UpdatedAfter) {
+		return false
+	}
+	if !o.UpdatedBefore.IsZero() && !entry.Updated.Before(o.UpdatedBefore) {
+		return false
+	}
+	return true
+}
+
+// The order of the listing. Ties on the sort field are broken by the name, and
+// a directory goes before a file with the same name, so no two entries are equal
+func (o ListOptions) compare(a, b ObjectInfo) int {
+	if o.DirectoriesFirst && a.IsDir != b.IsDir {
+		if a.IsDir {
+			return -1
+		}
+		return 1
+	}
+
+	var result int
+	switch o.sortBy() {
+	case SortBySize:
+		result = cmp.Compare(a.Size, b.Size)
+	case SortByUpdated:
+		result = a.Updated.Compare(b.Updated)
+	}
+	if result == 0 {
+		result = strings.Compare(a.Name, b.Name)
+	}
+	if result == 0 && a.IsDir != b.IsDir {
+		result = 1
+		if a.IsDir {
+			result = -1
+		}
+	}
+
+	if o.Descending {
+		return -result
+	}
+	return result
+}
+
+// ===================================
+// CURSORS
+// ===================================
+
+// Everything compare needs to find our place again.
+// The sort settings are in there so that a cursor can't be used with different options
+type listCursor struct {
+	SortBy           SortField `json:"s"`
+	Descending       bool      `json:"d,omitempty"`
+	DirectoriesFirst bool      `json:"df,omitempty"`
+	Name             string    `json:"n"`
+	IsDir            bool      `json:"dir,omitempty"`
+	Size             int64     `json:"sz,omitempty"`
+	Updated          time.Time `json:"u,omitzero"`
+}
+
+func (o ListOptions) encodeCursor(last ObjectInfo) string {
+	raw, _ := json.Marshal(listCursor{
+		SortBy:           o.sortBy(),
+		Descending:       o.Descending,
+		DirectoriesFirst: o.DirectoriesFirst,
+		Name:             last.Name,
+		IsDir:            last.IsDir,
+		Size:             last.Size,
+		Updated:          last.Updated,
+	})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// The last entry of the previous page, or nil for the first page
+func (o ListOptions) decodeCursor() (*ObjectInfo, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if cursor.SortBy != o.sortBy() || cursor.Descending != o.Descending || cursor.DirectoriesFirst != o.DirectoriesFirst {
+		return nil, fmt.Errorf("%w: it belongs to a listing with different sorting", ErrInvalidCursor)
+	}
+
+	return &ObjectInfo{
+		Name:    cursor.Name,
+		IsDir:   cursor.IsDir,
+		Size:    cursor.Size,
+		Updated: cursor.Updated,
+	}, nil
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+func listNames(objects []ObjectInfo) []string {
+	names := make([]string, len(objects))
+	for i, obj := range objects {
+		names[i] = obj.Name
+		if obj.IsDir {
+			names[i] += "/"
+		}
+	}
+	return names
+}
+
+func TestListOptions(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	entries := func() []ObjectInfo {
+		return []ObjectInfo{
+			{Name: "archive", IsDir: true},
+			{Name: "b.pdf", Size: 300, Updated: now.Add(-3 * time.Hour)},
+			{Name: "a.PDF", Size: 100, Updated: now.Add(-1 * time.Hour)},
+			{Name: "notes.txt", Size: 200, Updated: now.Add(-2 * time.Hour)},
+			{Name: "c.pdf", Size: 100, Updated: now},
+		}
+	}
+
+	tests := []struct {
+		description string
+		opts        ListOptions
+		expected    []string
+	}{
+		{"Name", ListOptions{}, []string{"a.PDF", "archive/", "b.pdf", "c.pdf", "notes.txt"}},
+		{"Name descending", ListOptions{Descending: true}, []string{"notes.txt", "c.pdf", "b.pdf", "archive/", "a.PDF"}},
+		{"Largest first", ListOptions{SortBy: SortBySize, Descending: true}, []string{"b.pdf", "notes.txt", "c.pdf", "a.PDF", "archive/"}},
+		{"Newest first", ListOptions{SortBy: SortByUpdated, Descending: true}, []string{"c.pdf", "a.PDF", "notes.txt", "b.pdf", "archive/"}},
+		{"Directories first", ListOptions{DirectoriesFirst: true}, []string{"archive/", "a.PDF", "b.pdf", "c.pdf", "notes.txt"}},
+		{"Directories first, newest first", ListOptions{DirectoriesFirst: true, SortBy: SortByUpdated, Descending: true}, []string{"archive/", "c.pdf", "a.PDF", "notes.txt", "b.pdf"}},
+		{"Only PDFs", ListOptions{Extensions: []string{"pdf"}}, []string{"a.PDF", "b.pdf", "c.pdf"}},
+		{"Glob matches directories too", ListOptions{Glob: "a*"}, []string{"a.PDF", "archive/"}},
+		{"Size range", ListOptions{MinSize: 150, MaxSize: 250}, []string{"notes.txt"}},
+		{"Updated range", ListOptions{UpdatedAfter: now.Add(-150 * time.Minute), UpdatedBefore: now}, []string{"a.PDF", "notes.txt"}},
+	}
+
+	for _, test := range tests {
+		if err := test.opts.validate(); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.description, err)
+			continue
+		}
+		objects, _, hasMore, err := test.opts.page(entries())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.description, err)
+			continue
+		}
+		if names := listNames(objects); !slices.Equal(names, test.expected) || hasMore {
+			t.Errorf("%s: expected %q, got %q (hasMore: %v)", test.description, test.expected, names, hasMore)
+		}
+	}
+
+	t.Run("Invalid options", func(t *testing.T) {
+		for _, opts := range []ListOptions{
+			{SortBy: "colour"},
+			{Glob: "[a-"},
+			{MinSize: 10, MaxSize: 5},
+		} {
+			if err := opts.validate(); err == nil {
+				t.Errorf("validate(%+v): expected an error", opts)
+			}
+		}
+	})
+
+	t.Run("Cursors only work with the same sorting", func(t *testing.T) {
+		opts := ListOptions{SortBy: SortBySize, Limit: 2}
+		_, cursor, _, _ := opts.page(entries())
+
+		for _, other := range []ListOptions{
+			{SortBy: SortByName, Cursor: cursor},
+			{SortBy: SortBySize, Descending: true, Cursor: cursor},
+			{SortBy: SortBySize, DirectoriesFirst: true, Cursor: cursor},
+			{Cursor: "not a cursor"},
+		} {
+			if _, _, _, err := other.page(entries()); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("Expected an invalid cursor, got %v", err)
+			}
+		}
+	})
+}
+
+func TestListPaginationIsStable(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	randomEntry := func(i int) ObjectInfo {
+		return ObjectInfo{
+			Name:    fmt.Sprintf("file-%03d", i),
+			IsDir:   rng.IntN(5) == 0,
+			Size:    rng.Int64N(4), // Lots of ties
+			Updated: now.Add(time.Duration(rng.IntN(4)) * time.Minute),
+		}
+	}
+
+	// Every combination of sorting, at a few page sizes
+	var combinations []ListOptions
+	for _, sortBy := range []SortField{SortByName, SortBySize, SortByUpdated} {
+		for _, descending := range []bool{false, true} {
+			for _, directoriesFirst := range []bool{false, true} {
+				for limit := 1; limit <= 6; limit++ {
+					combinations = append(combinations, ListOptions{
+						SortBy:           sortBy,
+						Descending:       descending,
+						DirectoriesFirst: directoriesFirst,
+						Limit:            limit,
+					})
+				}
+			}
+		}
+	}
+
+	for _, opts := range combinations {
+		var entries []ObjectInfo
+		for i := range 20 {
+			entries = append(entries, randomEntry(i))
+		}
+
+		// Everything that is there from start to finish has to show up exactly once,
+		// even though files get added and removed between pages
+		survivors := map[string]int{}
+		for _, entry := range entries[:10] {
+			survivors[entry.Name] = 0
+		}
+
+		var previous *ObjectInfo
+		for page := 0; ; page++ {
+			objects, cursor, hasMore, err := opts.page(slices.Clone(entries))
+			if err != nil {
+				t.Fatalf("%+v: unexpected error: %v", opts, err)
+			}
+
+			for _, obj := range objects {
+				if previous != nil && opts.compare(*previous, obj) >= 0 {
+					t.Fatalf("%+v: %q came after %q", opts, obj.Name, previous.Name)
+				}
+				previous = &obj
+				if _, ok := survivors[obj.Name]; ok {
+					survivors[obj.Name]++
+				}
+			}
+
+			if !hasMore {
+				break
+			}
+			opts.Cursor = cursor
+
+			// Shake things up: delete one of the changing files and add a new one
+			entries = slices.DeleteFunc(entries, func(entry ObjectInfo) bool {
+				return entry.Name == fmt.Sprintf("file-%03d", 10+page)
+			})
+			entries = append(entries, randomEntry(100+page))
+		}
+
+		for name, seen := range survivors {
+			if seen != 1 {
+				t.Errorf("%+v: expected %q once, got it %d times", opts, name, seen)
+			}
+		}
+	}
+}
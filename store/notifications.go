@@ -0,0 +1,209 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// ===================================
+// GCS NOTIFICATIONS
+// ===================================
+//
+// Files also land in the bucket through other tools (gsutil, transfer jobs...)
+// which never go through the Store, so they never publish an Event.
+// GCS can tell us about every change through Pub/Sub instead:
+// https://cloud.google.com/storage/docs/pubsub-notifications
+//
+// gcloud storage buckets notifications create gs://<bucket> --topic=<topic> --payload-format=json
+//
+// The notifications are turned into the same Events as our own, so
+// subscribers don't care where a change came from. Changes made through the
+// Store show up twice (once from us, once from GCS), so subscribers should
+// be idempotent. The generation makes that easy.
+//
+// Either point a push subscription at NotificationHandler, or pull the
+// messages yourself and pass the attributes and data to DecodeNotification.
+
+const EventSourceGCS = "gcs"
+
+// Returned for notifications that don't translate into an Event.
+// Acknowledge them, they will never become useful
+var ErrNotificationIgnored = errors.New("notification ignored")
+
+// https://cloud.google.com/storage/docs/pubsub-notifications#events
+const (
+	notificationFinalize = "OBJECT_FINALIZE"
+	notificationDelete   = "OBJECT_DELETE"
+	notificationArchive  = "OBJECT_ARCHIVE"
+)
+
+// The parts of the object resource we care about. The JSON API sends the numbers as strings
+// https://cloud.google.com/storage/docs/json_api/v1/objects#resource
+type notificationObject struct {
+	Name        string            `json:"name"`
+	Bucket      string            `json:"bucket"`
+	Generation  int64             `json:"generation,string"`
+	Size        int64             `json:"size,string"`
+	ContentType string            `json:"contentType"`
+	Updated     time.Time         `json:"updated"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// Turns a notification into an Event.
+// attributes and data are the Pub/Sub message's attributes and (decoded) data.
+//
+// Returns ErrNotificationIgnored for:
+// 1) Objects in other buckets, or outside the BasePrefix
+// 2) Metadata updates
+// 3) The delete/archive of the old version when an object gets overwritten,
+// the OBJECT_FINALIZE of the new version already covers it. Pub/Sub doesn't
+// guarantee the order, so acting on it could undo the finalize
+func (s *Store) DecodeNotification(attributes map[string]string, data []byte) (*Event, error) {
+	if format := attributes["payloadFormat"]; format != "JSON_API_V1" {
+		return nil, fmt.Errorf("%w: unsupported payload format %q", ErrNotificationIgnored, format)
+	}
+
+	event := &Event{
+		ID:     attributes["objectId"] + "#" + attributes["objectGeneration"],
+		Source: EventSourceGCS,
+	}
+
+	switch eventType := attributes["eventType"]; eventType {
+	case notificationFinalize:
+		event.Type = EventObjectCreated
+	case notificationDelete, notificationArchive:
+		if attributes["overwrittenByGeneration"] != "" {
+			return nil, fmt.Errorf("%w: %s of an overwritten object", ErrNotificationIgnored, eventType)
+		}
+		// With versioning, a delete through the Store archives the live version.
+		// It's a delete all the same, whichever way we hear about it
+		event.Type = EventObjectDeleted
+		event.ID += "#" + strings.ToLower(eventType)
+	default:
+		return nil, fmt.Errorf("%w: event type %q", ErrNotificationIgnored, eventType)
+	}
+
+	var object notificationObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("failed to decode notification payload: %w", err)
+	}
+	if object.Name == "" {
+		return nil, fmt.Errorf("failed to decode notification payload: missing object name")
+	}
+
+	if object.Bucket != s.BucketName {
+		return nil, fmt.Errorf("%w: object in bucket %q", ErrNotificationIgnored, object.Bucket)
+	}
+	if s.BasePrefix != "" && !strings.HasPrefix(object.Name, strings.TrimSuffix(s.BasePrefix, "/")+"/") {
+		return nil, fmt.Errorf("%w: %s is outside of %s", ErrNotificationIgnored, object.Name, s.BasePrefix)
+	}
+
+	// Directories are just empty objects with a trailing slash
+	if event.Type == EventObjectCreated && strings.HasSuffix(object.Name, "/") {
+		event.Type = EventDirectoryCreated
+	}
+
+	event.Time = object.Updated
+	if eventTime, err := time.Parse(time.RFC3339Nano, attributes["eventTime"]); err == nil {
+		event.Time = eventTime
+	}
+	event.Bucket = object.Bucket
+	event.Tenant = tenantOf(s.BasePrefix, object.Name)
+	if event.Tenant == "" {
+		// A tenant store's BasePrefix already ends in tenant/<id>
+		event.Tenant = s.TenantID
+	}
+	event.Name = object.Name
+	event.Generation = object.Generation
+	event.Size = object.Size
+	event.ContentType = object.ContentType
+	event.Metadata = object.Metadata
+	return event, nil
+}
+
+// ===================================
+// PUSH SUBSCRIPTIONS
+// ===================================
+
+// What Pub/Sub POSTs to a push endpoint
+// https://cloud.google.com/pubsub/docs/push#receive_push
+type pushEnvelope struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       []byte            `json:"data"` // base64 in the JSON, decoded by encoding/json
+	} `json:"message"`
+}
+
+type NotificationHandlerOptions struct {
+	// When set, requests need a Google signed OIDC token for this audience,
+	// which is what push subscriptions with authentication send.
+	// https://cloud.google.com/pubsub/docs/authenticate-push-subscriptions
+	// Leave it empty only when something else authenticates the requests,
+	// otherwise anyone can make up events
+	Audience string
+
+	// The service account the push subscription authenticates as. Optional
+	ServiceAccountEmail string
+}
+
+// Receives notifications from a push subscription and publishes them on the Store's EventBus.
+// Anything that isn't a 2xx gets redelivered by Pub/Sub, so ignored notifications are acknowledged too
+func (s *Store) NotificationHandler(opts NotificationHandlerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if opts.Audience != "" {
+			if err := verifyPushToken(r, opts); err != nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var envelope pushEnvelope
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&envelope); err != nil {
+			http.Error(w, "invalid push message", http.StatusBadRequest)
+			return
+		}
+
+		event, err := s.DecodeNotification(envelope.Message.Attributes, envelope.Message.Data)
+		if errors.Is(err, ErrNotificationIgnored) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.Events != nil {
+			s.Events.Publish(*event)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func verifyPushToken(r *http.Request, opts NotificationHandlerOptions) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return errors.New("missing bearer token")
+	}
+
+	payload, err := idtoken.Validate(r.Context(), token, opts.Audience)
+	if err != nil {
+		return err
+	}
+	if opts.ServiceAccountEmail != "" && payload.Claims["email"] != opts.ServiceAccountEmail {
+		return fmt.Errorf("token is for %v, expected %s", payload.Claims["email"], opts.ServiceAccountEmail)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readNotification(t *testing.T, name string) (pushEnvelope, []byte) {
+	t.Helper()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "notifications", name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	var envelope pushEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		t.Fatalf("Failed to decode fixture: %v", err)
+	}
+	return envelope, raw
+}
+
+func TestDecodeNotification(t *testing.T) {
+	s := NewStore(nil, "my-bucket", "base")
+
+	tests := []struct {
+		fixture    string
+		eventType  EventType
+		name       string
+		tenant     string
+		generation int64
+		size       int64
+	}{
+		{"finalize.json", EventObjectCreated, "base/tenant/acme/reports/q3.pdf", "acme", 1760778902481993, 52341},
+		{"finalize_directory.json", EventDirectoryCreated, "base/tenant/acme/reports/", "acme", 1760778902481994, 0},
+		{"delete.json", EventObjectDeleted, "base/shared/old.txt", "", 1760778800000000, 12},
+		{"archive.json", EventObjectDeleted, "base/tenant/acme/reports/q2.pdf", "acme", 1760778700000000, 48000},
+	}
+
+	for _, test := range tests {
+		envelope, _ := readNotification(t, test.fixture)
+		event, err := s.DecodeNotification(envelope.Message.Attributes, envelope.Message.Data)
+		if err != nil {
+			t.Errorf("DecodeNotification(%s): unexpected error: %v", test.fixture, err)
+			continue
+		}
+
+		if event.Type != test.eventType || event.Name != test.name || event.Tenant != test.tenant {
+			t.Errorf("DecodeNotification(%s): unexpected event: %+v", test.fixture, event)
+		}
+		if event.Generation != test.generation || event.Size != test.size {
+			t.Errorf("DecodeNotification(%s): expected generation %d and size %d, got %d and %d", test.fixture, test.generation, test.size, event.Generation, event.Size)
+		}
+		if event.Source != EventSourceGCS || event.Bucket != "my-bucket" || event.ID == "" || event.Time.IsZero() {
+			t.Errorf("DecodeNotification(%s): missing details: %+v", test.fixture, event)
+		}
+	}
+
+	for _, fixture := range []string{"archive_overwritten.json", "metadata_update.json", "other_bucket.json"} {
+		envelope, _ := readNotification(t, fixture)
+		if _, err := s.DecodeNotification(envelope.Message.Attributes, envelope.Message.Data); !errors.Is(err, ErrNotificationIgnored) {
+			t.Errorf("DecodeNotification(%s): expected it to be ignored, got %v", fixture, err)
+		}
+	}
+
+	t.Run("Tenant stores keep the tenant", func(t *testing.T) {
+		acme, err := s.ForTenant("acme")
+		if err != nil {
+			t.Fatalf("Failed to scope the store: %v", err)
+		}
+		envelope, _ := readNotification(t, "finalize.json")
+		event, err := acme.DecodeNotification(envelope.Message.Attributes, envelope.Message.Data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if event.Tenant != "acme" {
+			t.Errorf("Expected the tenant to be acme, got %q", event.Tenant)
+		}
+	})
+
+	t.Run("Outside the base prefix", func(t *testing.T) {
+		other := NewStore(nil, "my-bucket", "base/tenant/globex")
+		envelope, _ := readNotification(t, "finalize.json")
+		if _, err := other.DecodeNotification(envelope.Message.Attributes, envelope.Message.Data); !errors.Is(err, ErrNotificationIgnored) {
+			t.Errorf("Expected it to be ignored, got %v", err)
+		}
+	})
+
+	t.Run("Broken payload", func(t *testing.T) {
+		envelope, _ := readNotification(t, "finalize.json")
+		_, err := s.DecodeNotification(envelope.Message.Attributes, []byte("{not json"))
+		if err == nil || errors.Is(err, ErrNotificationIgnored) {
+			t.Errorf("Expected a decoding error, got %v", err)
+		}
+	})
+}
+
+func TestNotificationHandler(t *testing.T) {
+	bus := NewEventBus()
+	s := NewStoreWithOptions(nil, "my-bucket", "base", StoreOptions{Events: bus})
+	events, unsubscribe := bus.Subscribe(10)
+	defer unsubscribe()
+
+	handler := s.NotificationHandler(NotificationHandlerOptions{})
+
+	for _, fixture := range []string{"finalize.json", "metadata_update.json"} {
+		_, raw := readNotification(t, fixture)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw)))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("POST %s: expected %d, got %d", fixture, http.StatusNoContent, rec.Code)
+		}
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected only the finalize to be published, got %d events", len(events))
+	}
+	if event := <-events; event.Type != EventObjectCreated || event.Name != "base/tenant/acme/reports/q3.pdf" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("nope"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a malformed message to be rejected, got %d", rec.Code)
+	}
+
+	t.Run("Requires a token when an audience is set", func(t *testing.T) {
+		handler := s.NotificationHandler(NotificationHandlerOptions{Audience: "https://example.com/notifications"})
+		_, raw := readNotification(t, "finalize.json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw)))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %d, got %d", http.StatusUnauthorized, rec.Code)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// ===================================
+// STORE OPTIONS
+// ===================================
+//
+// The retry strategy described on the Store can be customized:
+// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#hdr-Retrying_failed_requests
+// https://cloud.google.com/storage/docs/samples/storage-configure-retries
+// We apply it to the bucket handle, and every object handle is created from
+// the bucket handle, so it ends up on every single request the store makes.
+
+type StoreOptions struct {
+	Upload  UploadOptions
+	Retry   RetryOptions
+	Signing SigningOptions
+
+	// Enforces usage limits on writes. Nil means no quotas
+	Quota *QuotaManager
+
+	// Where every change to the bucket gets recorded. Nil means no audit log
+	Audit AuditSink
+
+	// Where successful changes get published. Nil means no events
+	Events *EventBus
+
+	// The maximum time a single operation may take (listing a page,
+	// copying, deleting, composing...). Uploads and downloads stream an
+	// unknown amount of data, so they are only bound by their own context.
+	// Zero means no timeout
+	OperationTimeout time.Duration
+}
+
+// Zero values keep the library defaults
+type RetryOptions struct {
+	// The exponential backoff between attempts.
+	// The library defaults to starting at 1s, capped at 30s, with a multiplier of 2
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// The maximum number of attempts, including the first one.
+	// Zero retries until the context is done
+	MaxAttempts int
+
+	// Which operations get retried. The default (storage.RetryIdempotent) only
+	// retries when it's safe to do so, e.g. when there is a generation precondition.
+	// storage.RetryAlways also retries the rest, storage.RetryNever turns it off
+	Policy storage.RetryPolicy
+}
+
+func DefaultStoreOptions() StoreOptions {
+	return StoreOptions{
+		Upload: DefaultUploadOptions(),
+	}
+}
+
+// Translates our options into the ones the library understands
+func (r RetryOptions) retryOptions() []storage.RetryOption {
+	var opts []storage.RetryOption
+
+	if r.InitialBackoff > 0 || r.MaxBackoff > 0 || r.Multiplier > 0 {
+		opts = append(opts, storage.WithBackoff(gax.Backoff{
+			Initial:    r.InitialBackoff,
+			Max:        r.MaxBackoff,
+			Multiplier: r.Multiplier,
+		}))
+	}
+	if r.MaxAttempts > 0 {
+		opts = append(opts, storage.WithMaxAttempts(r.MaxAttempts))
+	}
+	if r.Policy != storage.RetryIdempotent {
+		opts = append(opts, storage.WithPolicy(r.Policy))
+	}
+
+	return opts
+}
+
+// Bounds a single operation by the OperationTimeout
+// Always call the cancel function, even when there is no timeout
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.OperationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.OperationTimeout)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// A client talking to a fake GCS that fails every request with a 503,
+// which is retryable. Returns how many requests it got
+func newUnavailableClient(t *testing.T) (*storage.Client, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := storage.NewClient(context.Background(),
+		option.WithoutAuthentication(),
+		option.WithEndpoint(server.URL+"/storage/v1/"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, &requests
+}
+
+func TestRetryOptions(t *testing.T) {
+	// Short enough for the test, the library default starts at 1s
+	fast := RetryOptions{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}
+
+	tests := []struct {
+		name     string
+		retry    func(r RetryOptions) RetryOptions
+		expected int32
+	}{
+		{"Max attempts", func(r RetryOptions) RetryOptions { r.MaxAttempts = 3; return r }, 3},
+		{"Retry never", func(r RetryOptions) RetryOptions { r.MaxAttempts = 3; r.Policy = storage.RetryNever; return r }, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, requests := newUnavailableClient(t)
+			opts := DefaultStoreOptions()
+			opts.Retry = test.retry(fast)
+			s := NewStoreWithOptions(client, "bucket", "", opts)
+
+			if _, err := s.getObject("file.txt").Attrs(context.Background()); err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if got := requests.Load(); got != test.expected {
+				t.Errorf("Expected %d requests, got %d", test.expected, got)
+			}
+		})
+	}
+
+	t.Run("Library defaults", func(t *testing.T) {
+		if opts := (RetryOptions{}).retryOptions(); len(opts) != 0 {
+			t.Errorf("Expected the bucket's own retryer, got %d options", len(opts))
+		}
+	})
+}
+
+func TestOperationTimeout(t *testing.T) {
+	t.Run("No timeout", func(t *testing.T) {
+		s := NewStore(nil, "bucket", "")
+		ctx, cancel := s.withTimeout(context.Background())
+		defer cancel()
+
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("Expected no deadline")
+		}
+	})
+
+	t.Run("Stops retrying at the timeout", func(t *testing.T) {
+		// The library retries a 503 until the context is done
+		client, requests := newUnavailableClient(t)
+		opts := DefaultStoreOptions()
+		opts.OperationTimeout = 200 * time.Millisecond
+		s := NewStoreWithOptions(client, "bucket", "", opts)
+
+		start := time.Now()
+		_, _, _, err := s.ListPaginatedObjects(context.Background(), "", "", 10)
+		// The library doesn't wrap the context error, only mentions it
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Expected to give up after the timeout, took %v", elapsed)
+		}
+		if requests.Load() == 0 {
+			t.Errorf("Expected at least one request")
+		}
+	})
+
+	t.Run("With timeout", func(t *testing.T) {
+		opts := DefaultStoreOptions()
+		opts.OperationTimeout = time.Minute
+		s := NewStoreWithOptions(nil, "bucket", "", opts)
+
+		ctx, cancel := s.withTimeout(context.Background())
+		defer cancel()
+
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Fatalf("Expected a deadline")
+		}
+		if remaining := time.Until(deadline); remaining <= 0 || remaining > time.Minute {
+			t.Errorf("Expected the deadline within a minute, got %v", remaining)
+		}
+	})
+}
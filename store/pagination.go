@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// PAGINATION
+// ===================================
+//
+// Paging through a directory with GCS has three traps:
+// 1) StartOffset is inclusive. Passing the last name of the previous page
+// returns that entry again
+// 2) With a delimiter, a subdirectory comes back as a single prefix ("docs/").
+// Starting from "docs/" returns that prefix again, since "docs/a.txt" comes after it
+// 3) The listing is only sorted page by page. Each response has the files and
+// the prefixes in separate lists, and the client hands out all the files of a
+// page before its prefixes. So "docs/" can come after "e.txt"
+//
+// So we sort every page we get from GCS before going through it (the pages
+// themselves are in order), and the cursor is the full name (or prefix) of
+// the last entry we returned:
+// 1) For a file we start at the file itself, and skip it
+// 2) For a directory we start at the first name that can't be inside it,
+// e.g. "docs0" for "docs/" ('0' comes right after '/')
+// 3) To know whether there is more, we look for one more entry we would have
+// returned. The next page starts after the last entry we did return, not after
+// whatever we looked at, so nothing gets lost
+//
+// Entries we never return (the placeholder of the directory itself, our
+// temporary parts, whatever the caller filters out) don't count towards the
+// limit, nor as "more".
+//
+// With WithDirectoriesFirst, we go through the directory twice: once for
+// the subdirectories and once for the files. The cursor tells us which one
+// we're in, since only a directory's ends with a slash. After the last
+// directory the files start from the top. Finding the directories still means
+// listing all the files, so that's twice the requests (unless it's an Index).
+
+// Options for ListPaginatedObjects
+type PageOption func(*pageConfig)
+
+type pageConfig struct {
+	directoriesFirst bool
+}
+
+// All the subdirectories before the files, each in lexicographic order
+func WithDirectoriesFirst() PageOption {
+	return func(c *pageConfig) {
+		c.directoriesFirst = true
+	}
+}
+
+// Where the entries come from. The bucket, or an in-memory fake in the tests
+type objectSource interface {
+	Objects(ctx context.Context, q *storage.Query) objectIterator
+}
+
+// Satisfied by *storage.ObjectIterator
+type objectIterator interface {
+	Next() (*storage.ObjectAttrs, error)
+	PageInfo() *iterator.PageInfo
+}
+
+type bucketSource struct {
+	bucket *storage.BucketHandle
+}
+
+func (b bucketSource) Objects(ctx context.Context, q *storage.Query) objectIterator {
+	return b.bucket.Objects(ctx, q)
+}
+
+func (s *Store) objectSource() objectSource {
+	return bucketSource{bucket: s.getBucket()}
+}
+
+// The page of the directory that comes after startAfter (the lastObjectName of the previous page).
+// keep filters the entries, nil keeps everything
+func (s *Store) paginate(
+	ctx context.Context,
+	src objectSource,
+	fullPrefix, startAfter string,
+	limit int,
+	keep func(ObjectInfo) bool,
+	opts ...PageOption,
+) (
+	objects []ObjectInfo,
+	lastObjectName string,
+	hasMore bool,
+	err error,
+) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	var cfg pageConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.directoriesFirst {
+		return s.paginateDirectoriesFirst(ctx, src, fullPrefix, startAfter, limit, keep)
+	}
+
+	it := src.Objects(ctx, &storage.Query{
+		Prefix:      fullPrefix,
+		Delimiter:   "/", // NB: without this, we can't list "directories"
+		StartOffset: startOffset(startAfter),
+	})
+	// Just enough for a page and the peek at the next one, unless some get skipped
+	it.PageInfo().MaxSize = limit + 1
+
+	for {
+		batch, err := nextBatch(it)
+		if err != nil {
+			return nil, "", false, fmt.Errorf("error iterating objects: %v", err)
+		}
+		if len(batch) == 0 {
+			return objects, lastObjectName, false, nil
+		}
+
+		for _, attrs := range batch {
+			key := listingKey(attrs)
+			if startAfter != "" && key <= startAfter {
+				continue
+			}
+			entry, ok := s.objectInfo(fullPrefix, attrs)
+			if !ok || (keep != nil && !keep(entry)) {
+				continue
+			}
+
+			// A full page, and there is at least one more
+			if len(objects) == limit {
+				return objects, lastObjectName, true, nil
+			}
+			objects = append(objects, entry)
+			lastObjectName = key
+		}
+	}
+}
+
+// The directories, then the files, with the same cursor and hasMore as paginate
+func (s *Store) paginateDirectoriesFirst(
+	ctx context.Context,
+	src objectSource,
+	fullPrefix, startAfter string,
+	limit int,
+	keep func(ObjectInfo) bool,
+) (
+	objects []ObjectInfo,
+	lastObjectName string,
+	hasMore bool,
+	err error,
+) {
+	keepFiles := func(obj ObjectInfo) bool {
+		return !obj.IsDir && (keep == nil || keep(obj))
+	}
+	if startAfter != "" && !strings.HasSuffix(startAfter, "/") {
+		// Past the directories already
+		return s.paginate(ctx, src, fullPrefix, startAfter, limit, keepFiles)
+	}
+
+	objects, lastObjectName, hasMore, err = s.paginate(ctx, src, fullPrefix, startAfter, limit, func(obj ObjectInfo) bool {
+		return obj.IsDir && (keep == nil || keep(obj))
+	})
+	if err != nil || hasMore {
+		return objects, lastObjectName, hasMore, err
+	}
+
+	// Out of directories, the rest of the page are the first files
+	if len(objects) == limit {
+		// Only to know whether there are any
+		files, _, _, err := s.paginate(ctx, src, fullPrefix, "", 1, keepFiles)
+		if err != nil {
+			return nil, "", false, err
+		}
+		return objects, lastObjectName, len(files) > 0, nil
+	}
+	files, lastFile, hasMore, err := s.paginate(ctx, src, fullPrefix, "", limit-len(objects), keepFiles)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if len(files) > 0 {
+		lastObjectName = lastFile
+	}
+	return append(objects, files...), lastObjectName, hasMore, nil
+}
+
+// Everything GCS returned in one response, sorted. Empty at the end of the listing
+func nextBatch(it objectIterator) ([]*storage.ObjectAttrs, error) {
+	attrs, err := it.Next()
+	if err == iterator.Done {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Whatever is left in the buffer came with the same response
+	batch := []*storage.ObjectAttrs{attrs}
+	for range it.PageInfo().Remaining() {
+		attrs, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, attrs)
+	}
+
+	slices.SortFunc(batch, func(a, b *storage.ObjectAttrs) int {
+		return strings.Compare(listingKey(a), listingKey(b))
+	})
+	return batch, nil
+}
+
+// What the listing sorts on: the name of a file, or the prefix of a directory
+func listingKey(attrs *storage.ObjectAttrs) string {
+	if attrs.Prefix != "" {
+		return attrs.Prefix
+	}
+	return attrs.Name
+}
+
+// Where to start listing to get everything after the cursor
+func startOffset(cursor string) string {
+	if strings.HasSuffix(cursor, "/") {
+		return prefixSuccessor(cursor)
+	}
+	return cursor
+}
+
+// The smallest string that is larger than everything starting with the prefix
+// "docs/" -> "docs0"
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	// Only 0xff bytes, nothing comes after it
+	return ""
+}
@@ -0,0 +1,371 @@
+package store
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// FAKE LISTINGS
+// ===================================
+
+// Lists a fixed set of object names the way GCS does: StartOffset is
+// inclusive, the delimiter collapses subdirectories into prefixes, and each
+// page has its files first and its prefixes after
+type fakeSource struct {
+	names       []string
+	metadata    map[string]map[string]string // By name, optional
+	generations map[string]int64             // By name, optional
+}
+
+func (f fakeSource) Objects(_ context.Context, q *storage.Query) objectIterator {
+	var results []*storage.ObjectAttrs
+	seen := map[string]bool{}
+	for _, name := range f.names {
+		if !strings.HasPrefix(name, q.Prefix) || name < q.StartOffset {
+			continue
+		}
+		rest := strings.TrimPrefix(name, q.Prefix)
+		attrs := &storage.ObjectAttrs{Name: name, Metadata: f.metadata[name], Generation: f.generations[name]}
+		if i := strings.Index(rest, q.Delimiter); q.Delimiter != "" && i >= 0 {
+			attrs = &storage.ObjectAttrs{Prefix: q.Prefix + rest[:i+len(q.Delimiter)]}
+		}
+		if key := listingKey(attrs); !seen[key] {
+			seen[key] = true
+			results = append(results, attrs)
+		}
+	}
+	slices.SortFunc(results, func(a, b *storage.ObjectAttrs) int {
+		return strings.Compare(listingKey(a), listingKey(b))
+	})
+
+	it := &fakeIterator{}
+	fetch := func(pageSize int, token string) (string, error) {
+		if pageSize <= 0 || pageSize > 1000 {
+			pageSize = 1000
+		}
+		start, _ := strconv.Atoi(token)
+		end := min(start+pageSize, len(results))
+
+		page := results[start:end]
+		for _, attrs := range page {
+			if attrs.Prefix == "" {
+				it.items = append(it.items, attrs)
+			}
+		}
+		for _, attrs := range page {
+			if attrs.Prefix != "" {
+				it.items = append(it.items, attrs)
+			}
+		}
+
+		if end == len(results) {
+			return "", nil
+		}
+		return strconv.Itoa(end), nil
+	}
+	it.pageInfo, it.nextFunc = iterator.NewPageInfo(
+		fetch,
+		func() int { return len(it.items) },
+		func() any { b := it.items; it.items = nil; return b })
+	return it
+}
+
+type fakeIterator struct {
+	items    []*storage.ObjectAttrs
+	pageInfo *iterator.PageInfo
+	nextFunc func() error
+}
+
+func (it *fakeIterator) Next() (*storage.ObjectAttrs, error) {
+	if err := it.nextFunc(); err != nil {
+		return nil, err
+	}
+	attrs := it.items[0]
+	it.items = it.items[1:]
+	return attrs, nil
+}
+
+func (it *fakeIterator) PageInfo() *iterator.PageInfo {
+	return it.pageInfo
+}
+
+// Pages through the whole directory, checking every page on the way
+func pageThrough(
+	t *testing.T,
+	s *Store,
+	src objectSource,
+	fullPrefix string,
+	limit int,
+	keep func(ObjectInfo) bool,
+	opts ...PageOption,
+) []string {
+	t.Helper()
+
+	var names []string
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 1000 {
+			t.Fatalf("limit %d: the listing never ends", limit)
+		}
+
+		objects, last, hasMore, err := s.paginate(context.Background(), src, fullPrefix, cursor, limit, keep, opts...)
+		if err != nil {
+			t.Fatalf("limit %d: unexpected error: %v", limit, err)
+		}
+		if len(objects) > limit {
+			t.Fatalf("limit %d: got a page of %d", limit, len(objects))
+		}
+		if hasMore && len(objects) != limit {
+			t.Fatalf("limit %d: got a short page of %d that has more after it", limit, len(objects))
+		}
+		names = append(names, listNames(objects)...)
+
+		if !hasMore {
+			return names
+		}
+		// Directories first starts over at the files, so only the plain listing has to go up
+		if last == "" || (last <= cursor && len(opts) == 0) {
+			t.Fatalf("limit %d: the cursor went from %q to %q", limit, cursor, last)
+		}
+		cursor = last
+	}
+}
+
+// What a directory listing should return: everything directly inside, sorted by the name GCS has
+func expectedListing(names []string, fullPrefix string, keep func(ObjectInfo) bool) []string {
+	var expected []string
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(name, fullPrefix)
+		if !ok || rest == "" {
+			continue
+		}
+		entry := ObjectInfo{Name: rest}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			if isCompositePart("base", fullPrefix+rest[:i+1]) {
+				continue
+			}
+			entry = ObjectInfo{Name: rest[:i], IsDir: true}
+		}
+		if keep != nil && !keep(entry) {
+			continue
+		}
+		expected = append(expected, listNames([]ObjectInfo{entry})...)
+	}
+
+	// GCS sorts on the full key, "docs/" for a directory
+	slices.Sort(expected)
+	return slices.Compact(expected)
+}
+
+func TestPagination(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+
+	t.Run("Directories and files that sort around them", func(t *testing.T) {
+		// '-', '.' and ' ' all come before '/', so "docs-old.txt" is listed before "docs/"
+		src := fakeSource{names: []string{
+			"base/docs/a.txt",
+			"base/docs/b/c.txt",
+			"base/docs-old.txt",
+			"base/docs.txt",
+			"base/docs 2/d.txt",
+			"base/e.txt",
+			"base/f/",
+			"base/" + compositeTempDir + "/part-1",
+		}}
+		expected := []string{"docs 2/", "docs-old.txt", "docs.txt", "docs/", "e.txt", "f/"}
+
+		for limit := 1; limit <= len(expected)+1; limit++ {
+			if names := pageThrough(t, s, src, "base/", limit, nil); !slices.Equal(names, expected) {
+				t.Errorf("limit %d: expected %q, got %q", limit, expected, names)
+			}
+		}
+	})
+
+	t.Run("Only our own temporary parts are hidden", func(t *testing.T) {
+		src := fakeSource{names: []string{
+			"base/" + compositeTempDir + "/01J/part-1",
+			"base/photos/" + compositeTempDir + "/a.txt",
+			"base/tenant/acme/" + compositeTempDir + "/01J/part-1",
+			"base/tenant/acme/photos/" + compositeTempDir + "/b.txt",
+		}}
+		tests := []struct {
+			prefix   string
+			expected []string
+		}{
+			{"base/", []string{"photos/", "tenant/"}},
+			{"base/photos/", []string{compositeTempDir + "/"}},
+			{"base/photos/" + compositeTempDir + "/", []string{"a.txt"}},
+			{"base/tenant/acme/", []string{"photos/"}},
+			{"base/tenant/acme/photos/", []string{compositeTempDir + "/"}},
+		}
+
+		for _, test := range tests {
+			if names := pageThrough(t, s, src, test.prefix, 10, nil); !slices.Equal(names, test.expected) {
+				t.Errorf("%s: expected %q, got %q", test.prefix, test.expected, names)
+			}
+		}
+	})
+
+	t.Run("Skipped entries don't count as more", func(t *testing.T) {
+		// The placeholder of the directory itself is never listed
+		src := fakeSource{names: []string{"base/docs/", "base/docs/a.txt"}}
+		objects, _, hasMore, err := s.paginate(context.Background(), src, "base/docs/", "", 1, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if names := listNames(objects); !slices.Equal(names, []string{"a.txt"}) || hasMore {
+			t.Errorf("Expected only a.txt without more, got %q (hasMore: %v)", names, hasMore)
+		}
+	})
+
+	t.Run("Random trees at every limit", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(4, 3))
+		segments := []string{"a", "b", "a-b", "a.b", "a b", "a0", compositeTempDir}
+
+		for tree := range 100 {
+			var names []string
+			for range 1 + rng.IntN(40) {
+				parts := []string{"base"}
+				for range 1 + rng.IntN(3) {
+					parts = append(parts, segments[rng.IntN(len(segments))])
+				}
+				name := strings.Join(parts, "/")
+				if rng.IntN(4) == 0 {
+					name += "/" // A directory placeholder
+				}
+				names = append(names, name)
+			}
+			src := fakeSource{names: names}
+
+			var keep func(ObjectInfo) bool
+			if tree%2 == 1 {
+				// Like a GuardedStore hiding some of the entries
+				keep = func(obj ObjectInfo) bool { return !strings.HasPrefix(obj.Name, "a.") }
+			}
+
+			for _, fullPrefix := range []string{"base/", "base/a/", "base/a-b/"} {
+				expected := expectedListing(names, fullPrefix, keep)
+				for limit := 1; limit <= len(expected)+1; limit++ {
+					if result := pageThrough(t, s, src, fullPrefix, limit, keep); !slices.Equal(result, expected) {
+						t.Fatalf("tree %d, %q, limit %d: expected %q, got %q\nfrom %q", tree, fullPrefix, limit, expected, result, names)
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestPaginationDirectoriesFirst(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+
+	t.Run("Directories before the files", func(t *testing.T) {
+		src := fakeSource{names: []string{
+			"base/a.txt",
+			"base/b/c.txt",
+			"base/docs-old.txt",
+			"base/docs/d.txt",
+			"base/z/",
+		}}
+		expected := []string{"b/", "docs/", "z/", "a.txt", "docs-old.txt"}
+
+		for limit := 1; limit <= len(expected)+1; limit++ {
+			if names := pageThrough(t, s, src, "base/", limit, nil, WithDirectoriesFirst()); !slices.Equal(names, expected) {
+				t.Errorf("limit %d: expected %q, got %q", limit, expected, names)
+			}
+		}
+	})
+
+	t.Run("A page that ends on the last directory", func(t *testing.T) {
+		src := fakeSource{names: []string{"base/a.txt", "base/b/c.txt"}}
+		objects, last, hasMore, err := s.paginate(context.Background(), src, "base/", "", 1, nil, WithDirectoriesFirst())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if names := listNames(objects); !slices.Equal(names, []string{"b/"}) || last != "base/b/" || !hasMore {
+			t.Errorf("Expected b/ with more after it, got %q, %q (hasMore: %v)", names, last, hasMore)
+		}
+
+		// Only directories, nothing comes after the last one
+		src = fakeSource{names: []string{"base/b/c.txt"}}
+		if _, _, hasMore, _ := s.paginate(context.Background(), src, "base/", "", 1, nil, WithDirectoriesFirst()); hasMore {
+			t.Errorf("Expected no more without any files")
+		}
+	})
+
+	t.Run("Random trees at every limit", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(7, 2))
+		segments := []string{"a", "b", "a-b", "a.b", "a b", "a0", compositeTempDir}
+
+		for tree := range 100 {
+			var names []string
+			for range 1 + rng.IntN(40) {
+				parts := []string{"base"}
+				for range 1 + rng.IntN(3) {
+					parts = append(parts, segments[rng.IntN(len(segments))])
+				}
+				name := strings.Join(parts, "/")
+				if rng.IntN(4) == 0 {
+					name += "/"
+				}
+				names = append(names, name)
+			}
+			src := fakeSource{names: names}
+
+			var keep func(ObjectInfo) bool
+			if tree%2 == 1 {
+				keep = func(obj ObjectInfo) bool { return !strings.HasPrefix(obj.Name, "a.") }
+			}
+
+			for _, fullPrefix := range []string{"base/", "base/a/", "base/a-b/"} {
+				listing := expectedListing(names, fullPrefix, keep)
+				var expected, files []string
+				for _, name := range listing {
+					if strings.HasSuffix(name, "/") {
+						expected = append(expected, name)
+					} else {
+						files = append(files, name)
+					}
+				}
+				expected = append(expected, files...)
+
+				for limit := 1; limit <= len(expected)+1; limit++ {
+					if result := pageThrough(t, s, src, fullPrefix, limit, keep, WithDirectoriesFirst()); !slices.Equal(result, expected) {
+						t.Fatalf("tree %d, %q, limit %d: expected %q, got %q\nfrom %q", tree, fullPrefix, limit, expected, result, names)
+					}
+				}
+			}
+		}
+	})
+}
+
+func TestStartOffset(t *testing.T) {
+	tests := []struct {
+		cursor   string
+		expected string
+	}{
+		{"", ""},
+		{"base/a.txt", "base/a.txt"},
+		{"base/docs/", "base/docs0"},
+		{"base/\xff/", "base/\xff0"},
+		{"\xff", "\xff"},
+	}
+
+	for i, test := range tests {
+		result := startOffset(test.cursor)
+		if result != test.expected {
+			t.Errorf("startOffset(%d): expected %q, got %q", i, test.expected, result)
+		}
+	}
+
+	if result := prefixSuccessor("a\xff\xff"); result != "b" {
+		t.Errorf("Expected %q, got %q", "b", result)
+	}
+}
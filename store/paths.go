@@ -0,0 +1,128 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ===================================
+// PATH VALIDATION
+// ===================================
+//
+// The prefix and filename usually come straight from the user.
+// Without checking them, something like "../../other-tenant/secret.txt"
+// happily escapes the BasePrefix after a path.Join.
+// Every operation resolves its paths through here, so there is one place
+// that decides what a valid name looks like.
+//
+// The GCS naming rules:
+// https://cloud.google.com/storage/docs/objects#naming
+
+// GCS limits object names to 1024 bytes of UTF-8
+const MaxObjectNameLength = 1024
+
+// Use errors.Is(err, ErrInvalidPath) to check for any invalid path
+var ErrInvalidPath = errors.New("invalid path")
+
+// Returned when a user supplied path can't be used
+type InvalidPathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("invalid path %q: %s", e.Path, e.Reason)
+}
+
+func (e *InvalidPathError) Is(target error) bool {
+	return target == ErrInvalidPath
+}
+
+// Joins and normalizes user supplied path parts into a path relative to
+// the BasePrefix. Returns "" for the root.
+// Handlers can use this to validate input before it reaches the store
+func CleanPath(parts ...string) (string, error) {
+	joined := strings.Join(parts, "/")
+
+	if !utf8.ValidString(joined) {
+		return "", &InvalidPathError{Path: joined, Reason: "not valid UTF-8"}
+	}
+	for _, r := range joined {
+		if unicode.IsControl(r) {
+			return "", &InvalidPathError{Path: joined, Reason: "contains control characters"}
+		}
+	}
+
+	// path.Clean sorts out things like "a//b" and "a/./b", and resolves ".."
+	// Anything that still starts with ".." was trying to climb out
+	cleaned := path.Clean(strings.TrimLeft(joined, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &InvalidPathError{Path: joined, Reason: "escapes the base prefix"}
+	}
+	if cleaned == "." {
+		cleaned = ""
+	}
+
+	// Reserved by GCS
+	if strings.HasPrefix(cleaned, ".well-known/acme-challenge/") {
+		return "", &InvalidPathError{Path: joined, Reason: "reserved name"}
+	}
+	// Reserved for the temporary parts of parallel uploads (see composite.go)
+	if cleaned == compositeTempDir || strings.HasPrefix(cleaned, compositeTempDir+"/") {
+		return "", &InvalidPathError{Path: joined, Reason: "reserved name"}
+	}
+
+	return cleaned, nil
+}
+
+// Resolves a user supplied path to the full name of an object under the BasePrefix.
+// The path can't be empty, since that would be the BasePrefix itself
+func (s *Store) objectPath(parts ...string) (string, error) {
+	relative, err := CleanPath(parts...)
+	if err != nil {
+		return "", err
+	}
+	if relative == "" {
+		return "", &InvalidPathError{Path: strings.Join(parts, "/"), Reason: "empty name"}
+	}
+	return s.fullPath(relative)
+}
+
+// Resolves a user supplied path to a directory prefix under the BasePrefix.
+// The result ends in a slash, unless it's the root of a store without a BasePrefix
+func (s *Store) directoryPath(parts ...string) (string, error) {
+	relative, err := CleanPath(parts...)
+	if err != nil {
+		return "", err
+	}
+
+	fullPath, err := s.fullPath(relative)
+	if err != nil {
+		return "", err
+	}
+	if fullPath != "" && !strings.HasSuffix(fullPath, "/") {
+		fullPath += "/"
+	}
+	return fullPath, nil
+}
+
+func (s *Store) fullPath(relative string) (string, error) {
+	fullPath := path.Join(s.BasePrefix, relative)
+	if fullPath == "." {
+		fullPath = ""
+	}
+
+	// Leave room for the trailing slash of a directory
+	if len(fullPath)+1 > MaxObjectNameLength {
+		return "", &InvalidPathError{Path: relative, Reason: fmt.Sprintf("longer than %d bytes", MaxObjectNameLength)}
+	}
+	// The parent store can reach into a tenant's, e.g. "tenant/acme/.composite"
+	if isCompositePart(s.BasePrefix, fullPath+"/") {
+		return "", &InvalidPathError{Path: relative, Reason: "reserved name"}
+	}
+	return fullPath, nil
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	valid := []struct {
+		parts    []string
+		expected string
+	}{
+		{[]string{"", ""}, ""},
+		{[]string{"docs", "report.pdf"}, "docs/report.pdf"},
+		{[]string{"/docs/", "report.pdf"}, "docs/report.pdf"},
+		{[]string{"docs//nested/./", "report.pdf"}, "docs/nested/report.pdf"},
+		{[]string{"docs/../images", "cat.png"}, "images/cat.png"}, // Climbs, but stays inside
+		{[]string{"", "résumé.pdf"}, "résumé.pdf"},
+		{[]string{"", "..hidden"}, "..hidden"},
+		{[]string{"photos/.composite", "a.txt"}, "photos/.composite/a.txt"}, // Only reserved at the root
+	}
+
+	for _, test := range valid {
+		result, err := CleanPath(test.parts...)
+		if err != nil {
+			t.Errorf("CleanPath(%q): unexpected error: %v", test.parts, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("CleanPath(%q): expected %q, got %q", test.parts, test.expected, result)
+		}
+	}
+
+	invalid := [][]string{
+		{"..", "secret.txt"},
+		{"", "../secret.txt"},
+		{"docs", "../../secret.txt"},
+		{"docs/../..", "secret.txt"},
+		{"/../", "secret.txt"},
+		{"", "new\nline.txt"},
+		{"", "null\x00byte.txt"},
+		{"", "bell\a.txt"},
+		{"", "\xff\xfe"},
+		{".well-known/acme-challenge", "token"},
+		{".composite", "part-1"},
+		{"", ".composite"},
+		{"docs/..", ".composite/part-1"},
+	}
+
+	for _, parts := range invalid {
+		_, err := CleanPath(parts...)
+		if err == nil {
+			t.Errorf("CleanPath(%q): expected an error", parts)
+			continue
+		}
+
+		var pathErr *InvalidPathError
+		if !errors.As(err, &pathErr) || !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("CleanPath(%q): expected an InvalidPathError, got %T", parts, err)
+		}
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+
+	t.Run("Stays under the base prefix", func(t *testing.T) {
+		result, err := s.objectPath("docs", "report.pdf")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if result != "base/docs/report.pdf" {
+			t.Errorf("Expected %q, got %q", "base/docs/report.pdf", result)
+		}
+	})
+
+	t.Run("Can't be the base prefix itself", func(t *testing.T) {
+		if _, err := s.objectPath("docs", ".."); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected an invalid path, got %v", err)
+		}
+	})
+
+	t.Run("Too long", func(t *testing.T) {
+		if _, err := s.objectPath("", strings.Repeat("a", MaxObjectNameLength)); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected an invalid path, got %v", err)
+		}
+	})
+
+	t.Run("Can't reach into a tenant's temporary parts", func(t *testing.T) {
+		if _, err := s.objectPath("tenant/acme/.composite", "part-1"); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected an invalid path, got %v", err)
+		}
+		if _, err := s.directoryPath("tenant/acme/.composite"); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected an invalid path, got %v", err)
+		}
+		if _, err := s.objectPath("tenant/acme/photos/.composite", "a.txt"); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Directories", func(t *testing.T) {
+		tests := []struct {
+			store    *Store
+			prefix   string
+			expected string
+		}{
+			{s, "", "base/"},
+			{s, "docs", "base/docs/"},
+			{s, "docs/", "base/docs/"},
+			{NewStore(nil, "bucket", ""), "", ""},
+			{NewStore(nil, "bucket", ""), "docs", "docs/"},
+		}
+
+		for _, test := range tests {
+			result, err := test.store.directoryPath(test.prefix)
+			if err != nil {
+				t.Errorf("directoryPath(%q): unexpected error: %v", test.prefix, err)
+				continue
+			}
+			if result != test.expected {
+				t.Errorf("directoryPath(%q): expected %q, got %q", test.prefix, test.expected, result)
+			}
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// SIGNED POST POLICIES
+// ===================================
+//
+// Signed URLs are great for fetch/XHR, but a plain HTML form can only POST.
+// A POST policy is a signed document listing the conditions the upload has
+// to meet. GCS enforces them, so the browser can't sneak in a bigger file or
+// write outside the prefix we handed out.
+// https://cloud.google.com/storage/docs/xml-api/post-object-forms
+// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_BucketHandle_GenerateSignedPostPolicyV4
+//
+// The front end renders every field as a hidden input, followed by the file
+// input (which must be last):
+// <form action="{url}" method="POST" enctype="multipart/form-data">
+//   <input type="hidden" name="{key}" value="{value}"> ...
+//   <input type="file" name="file">
+// </form>
+
+// GCS replaces this with the name of the file the user picked
+const uploadedFilenameVariable = "${filename}"
+
+type PostPolicyOptions struct {
+	// How long the form stays valid. Defaults to DefaultSignedURLExpiry
+	Expires time.Duration
+
+	// The maximum number of bytes the form may upload. Zero means no limit
+	MaxSize int64
+
+	// Either an exact content type like "application/pdf", or a family ending
+	// in a slash like "image/". The browser must send it as a Content-Type field
+	ContentType string
+
+	// The status code GCS responds with when the upload succeeds. GCS uses 204 by default
+	SuccessStatus int
+}
+
+// Everything the front end needs to embed in the form
+type PostPolicy struct {
+	URL     string            `json:"url"`
+	Fields  map[string]string `json:"fields"`
+	Expires time.Time         `json:"expires"`
+}
+
+// Generates a signed POST policy for uploading into prefix.
+// With a filename, the form can only upload to prefix/filename.
+// With an empty filename, the name of the uploaded file is used
+func (s *Store) SignedPostPolicy(
+	prefix, filename string,
+	opts PostPolicyOptions,
+) (*PostPolicy, error) {
+	expires, err := SignedURLOptions{Expires: opts.Expires}.expiry()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPrefix, err := s.directoryPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	key := keyPrefix + uploadedFilenameVariable
+	if filename != "" {
+		if key, err = s.objectPath(prefix, filename); err != nil {
+			return nil, err
+		}
+	}
+
+	conditions := []storage.PostPolicyV4Condition{
+		// The key is already pinned by the library, this makes the prefix explicit
+		storage.ConditionStartsWith("$key", keyPrefix),
+	}
+	if opts.MaxSize > 0 {
+		conditions = append(conditions, storage.ConditionContentLengthRange(0, uint64(opts.MaxSize)))
+	}
+
+	fields := &storage.PolicyV4Fields{
+		StatusCodeOnSuccess: opts.SuccessStatus,
+	}
+	switch {
+	case strings.HasSuffix(opts.ContentType, "/"):
+		// The browser fills in the exact type, we only check the family
+		conditions = append(conditions, storage.ConditionStartsWith("$Content-Type", opts.ContentType))
+	case opts.ContentType != "":
+		fields.ContentType = opts.ContentType
+	}
+
+	policy, err := s.getBucket().GenerateSignedPostPolicyV4(key, &storage.PostPolicyV4Options{
+		GoogleAccessID: s.Signing.GoogleAccessID,
+		PrivateKey:     s.Signing.PrivateKey,
+		SignBytes:      s.Signing.SignBytes,
+		Expires:        expires,
+		Fields:         fields,
+		Conditions:     conditions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign POST policy for %s: %w", key, err)
+	}
+
+	return &PostPolicy{
+		URL:     policy.URL,
+		Fields:  policy.Fields,
+		Expires: expires,
+	}, nil
+}
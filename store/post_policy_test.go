@@ -0,0 +1,71 @@
+package store
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSignedPostPolicy(t *testing.T) {
+	s := newSigningStore(t)
+
+	// The conditions live in the base64 encoded policy document
+	decodePolicy := func(t *testing.T, policy *PostPolicy) string {
+		doc, err := base64.StdEncoding.DecodeString(policy.Fields["policy"])
+		if err != nil {
+			t.Fatalf("Failed to decode policy: %v", err)
+		}
+		return string(doc)
+	}
+
+	t.Run("Any file under the prefix", func(t *testing.T) {
+		policy, err := s.SignedPostPolicy("uploads", "", PostPolicyOptions{
+			MaxSize:     5 * 1024 * 1024,
+			ContentType: "image/",
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate policy: %v", err)
+		}
+
+		if policy.Fields["key"] != "base/uploads/${filename}" {
+			t.Errorf("Expected the key to use the uploaded filename, got %q", policy.Fields["key"])
+		}
+		if policy.Fields["x-goog-signature"] == "" {
+			t.Errorf("Expected the policy to be signed")
+		}
+		if _, ok := policy.Fields["content-type"]; ok {
+			t.Errorf("Expected the content type to be left to the browser")
+		}
+
+		doc := decodePolicy(t, policy)
+		for _, condition := range []string{
+			`["starts-with","$key","base/uploads/"]`,
+			`["content-length-range",0,5242880]`,
+			`["starts-with","$Content-Type","image/"]`,
+		} {
+			if !strings.Contains(doc, condition) {
+				t.Errorf("Expected the policy to contain %s, got %s", condition, doc)
+			}
+		}
+	})
+
+	t.Run("Exact file and content type", func(t *testing.T) {
+		policy, err := s.SignedPostPolicy("uploads", "avatar.png", PostPolicyOptions{
+			ContentType:   "image/png",
+			SuccessStatus: 201,
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate policy: %v", err)
+		}
+
+		if policy.Fields["key"] != "base/uploads/avatar.png" {
+			t.Errorf("Expected the exact key, got %q", policy.Fields["key"])
+		}
+		if policy.Fields["content-type"] != "image/png" {
+			t.Errorf("Expected a fixed content type, got %q", policy.Fields["content-type"])
+		}
+		if policy.Fields["success_action_status"] != "201" {
+			t.Errorf("Expected the success status to be set, got %q", policy.Fields["success_action_status"])
+		}
+	})
+}
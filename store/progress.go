@@ -0,0 +1,180 @@
+package store
+
+import (
+	"io"
+	"time"
+)
+
+// ===================================
+// TRANSFER PROGRESS
+// ===================================
+//
+// For big files the UI has no clue how far an upload or download has got.
+// We wrap the reader that feeds the transfer and count the bytes flowing
+// through it. The callback is rate-limited so that it can be pushed straight
+// over a websocket or SSE without flooding the client.
+
+// The default time between two progress reports
+const DefaultProgressInterval = 500 * time.Millisecond
+
+// A snapshot of how far a transfer has got.
+// TotalBytes is -1 when we don't know the size up front (e.g. an upload from
+// a stream without a size hint)
+type Progress struct {
+	BytesTransferred int64         `json:"bytes_transferred"`
+	TotalBytes       int64         `json:"total_bytes"`
+	BytesPerSecond   float64       `json:"bytes_per_second"`
+	Elapsed          time.Duration `json:"elapsed"`
+	Done             bool          `json:"done"`
+}
+
+// Returns how far we are as a number between 0 and 100
+// or -1 if the total size is unknown
+func (p Progress) Percent() float64 {
+	if p.TotalBytes <= 0 {
+		return -1
+	}
+	return float64(p.BytesTransferred) / float64(p.TotalBytes) * 100
+}
+
+// Gets called with the latest progress of a transfer
+type ProgressFunc func(Progress)
+
+// Turns a channel into a ProgressFunc.
+// The send never blocks: if the receiver is not keeping up the update is
+// dropped, since a newer one will be along shortly. Don't rely on seeing
+// the Done update, the return value of the transfer is the source of truth.
+func ProgressChannel(ch chan<- Progress) ProgressFunc {
+	return func(p Progress) {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// The optional settings of a single upload or download
+type transferConfig struct {
+	progress         ProgressFunc
+	progressInterval time.Duration
+	totalSize        int64
+}
+
+// Functional options for UploadFile and DownloadFile
+type TransferOption func(*transferConfig)
+
+// Report the progress of the transfer to fn
+func WithProgress(fn ProgressFunc) TransferOption {
+	return func(c *transferConfig) {
+		c.progress = fn
+	}
+}
+
+// Change how often progress is reported. The final report is always sent
+func WithProgressInterval(interval time.Duration) TransferOption {
+	return func(c *transferConfig) {
+		c.progressInterval = interval
+	}
+}
+
+// Tell the upload how big the stream is going to be.
+// Useful for something like a multipart form where we know the size
+// from the header, but the reader can't tell us
+func WithTotalSize(size int64) TransferOption {
+	return func(c *transferConfig) {
+		c.totalSize = size
+	}
+}
+
+func newTransferConfig(opts []TransferOption) *transferConfig {
+	cfg := &transferConfig{
+		progressInterval: DefaultProgressInterval,
+		totalSize:        -1,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Readers like bytes.Reader and strings.Reader know how much is left
+type lenReader interface {
+	Len() int
+}
+
+// Tries to figure out the size of an upload if no hint was given
+func (c *transferConfig) sizeOf(r io.Reader) int64 {
+	if c.totalSize >= 0 {
+		return c.totalSize
+	}
+	if lr, ok := r.(lenReader); ok {
+		return int64(lr.Len())
+	}
+	return -1
+}
+
+// Wraps the reader so that progress is reported while it gets drained.
+// If no callback is set it only counts the bytes
+func (c *transferConfig) track(r io.Reader, total int64) *progressReader {
+	return &progressReader{
+		reader:   r,
+		fn:       c.progress,
+		interval: c.progressInterval,
+		total:    total,
+		start:    time.Now(),
+	}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	fn       ProgressFunc
+	interval time.Duration
+	total    int64
+	read     int64
+	start    time.Time
+	last     time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.read += int64(n)
+
+	if p.fn != nil && n > 0 {
+		now := time.Now()
+		if now.Sub(p.last) >= p.interval {
+			p.last = now
+			p.fn(p.snapshot(now, false))
+		}
+	}
+	return n, err
+}
+
+// Sends the final report. Should only be called once the transfer succeeded
+func (p *progressReader) finish() {
+	if p.fn != nil {
+		p.fn(p.snapshot(time.Now(), true))
+	}
+}
+
+func (p *progressReader) snapshot(now time.Time, done bool) Progress {
+	elapsed := now.Sub(p.start)
+
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(p.read) / elapsed.Seconds()
+	}
+
+	total := p.total
+	if done && total < 0 {
+		// Now we know
+		total = p.read
+	}
+
+	return Progress{
+		BytesTransferred: p.read,
+		TotalBytes:       total,
+		BytesPerSecond:   rate,
+		Elapsed:          elapsed,
+		Done:             done,
+	}
+}
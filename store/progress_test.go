@@ -0,0 +1,102 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	const contents = "some bytes that we are going to count"
+
+	t.Run("Reports every read without an interval", func(t *testing.T) {
+		var reports []Progress
+		cfg := newTransferConfig([]TransferOption{
+			WithProgress(func(p Progress) { reports = append(reports, p) }),
+			WithProgressInterval(0),
+		})
+
+		// Read 4 bytes at a time, so we get lots of reports
+		r := strings.NewReader(contents)
+		tracked := cfg.track(r, cfg.sizeOf(r))
+		buf := make([]byte, 4)
+		for {
+			if _, err := tracked.Read(buf); err == io.EOF {
+				break
+			}
+		}
+		tracked.finish()
+
+		if len(reports) < 2 {
+			t.Fatalf("Expected several reports, got %d", len(reports))
+		}
+
+		last := reports[len(reports)-1]
+		if !last.Done {
+			t.Errorf("Expected the last report to be done")
+		}
+		if last.BytesTransferred != int64(len(contents)) {
+			t.Errorf("Expected %d bytes transferred, got %d", len(contents), last.BytesTransferred)
+		}
+		if last.TotalBytes != int64(len(contents)) {
+			t.Errorf("Expected a total of %d bytes, got %d", len(contents), last.TotalBytes)
+		}
+		if last.Percent() != 100 {
+			t.Errorf("Expected 100%%, got %.1f", last.Percent())
+		}
+
+		for i := 1; i < len(reports); i++ {
+			if reports[i].BytesTransferred < reports[i-1].BytesTransferred {
+				t.Fatalf("Progress went backwards: %d then %d", reports[i-1].BytesTransferred, reports[i].BytesTransferred)
+			}
+		}
+	})
+
+	t.Run("Rate limits the reports", func(t *testing.T) {
+		var reports []Progress
+		cfg := newTransferConfig([]TransferOption{
+			WithProgress(func(p Progress) { reports = append(reports, p) }),
+			WithProgressInterval(time.Hour),
+		})
+
+		tracked := cfg.track(strings.NewReader(contents), -1)
+		buf := make([]byte, 4)
+		for {
+			if _, err := tracked.Read(buf); err == io.EOF {
+				break
+			}
+		}
+		tracked.finish()
+
+		// The first read and the final report
+		if len(reports) != 2 {
+			t.Fatalf("Expected 2 reports, got %d", len(reports))
+		}
+		if reports[0].TotalBytes != -1 {
+			t.Errorf("Expected an unknown total while in flight, got %d", reports[0].TotalBytes)
+		}
+		if reports[1].TotalBytes != int64(len(contents)) {
+			t.Errorf("Expected the total to be known when done, got %d", reports[1].TotalBytes)
+		}
+	})
+
+	t.Run("Size hint wins", func(t *testing.T) {
+		cfg := newTransferConfig([]TransferOption{WithTotalSize(42)})
+		if size := cfg.sizeOf(bytes.NewReader([]byte(contents))); size != 42 {
+			t.Errorf("Expected the size hint of 42, got %d", size)
+		}
+	})
+
+	t.Run("Channel never blocks", func(t *testing.T) {
+		ch := make(chan Progress, 1)
+		fn := ProgressChannel(ch)
+		fn(Progress{BytesTransferred: 1})
+		fn(Progress{BytesTransferred: 2}) // Dropped since nobody is reading
+
+		if p := <-ch; p.BytesTransferred != 1 {
+			t.Errorf("Expected the first update, got %d", p.BytesTransferred)
+		}
+	})
+}
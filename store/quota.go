@@ -0,0 +1,442 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// QUOTAS
+// ===================================
+//
+// Once tenants share a bucket we need to cap them.
+// The QuotaManager keeps a running total of the bytes and objects under every
+// prefix that has a limit. Writes that would go over the limit are rejected
+// before anything gets committed.
+//
+// The totals live in memory, so:
+// 1) Call ReconcileQuotas at startup to count what is already in the bucket
+// 2) Call it every now and then, since files can arrive without going through the Store
+//
+// Only live objects count. Noncurrent versions kept by EnableVersioning and
+// directory placeholders don't.
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Zero means there is no limit
+type QuotaLimit struct {
+	MaxBytes   int64 `json:"max_bytes"`
+	MaxObjects int64 `json:"max_objects"`
+}
+
+type QuotaUsage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// Returned when a write would take a prefix over its limit
+type QuotaExceededError struct {
+	Prefix    string
+	Limit     QuotaLimit
+	Usage     QuotaUsage
+	Requested QuotaUsage
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf(
+		"quota exceeded for %q: using %s in %d objects, limit is %s in %d objects",
+		e.Prefix,
+		FormatBytes(e.Usage.Bytes), e.Usage.Objects,
+		FormatBytes(e.Limit.MaxBytes), e.Limit.MaxObjects,
+	)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Safe for concurrent use. Share a single one between a Store and its tenant stores
+type QuotaManager struct {
+	mu     sync.Mutex
+	limits map[string]QuotaLimit
+	usage  map[string]QuotaUsage
+}
+
+func NewQuotaManager() *QuotaManager {
+	return &QuotaManager{
+		limits: map[string]QuotaLimit{},
+		usage:  map[string]QuotaUsage{},
+	}
+}
+
+// The prefix is the full prefix in the bucket, e.g. "tenant/acme/"
+// Prefer Store.SetQuota, which works that out for you
+func (q *QuotaManager) SetLimit(prefix string, limit QuotaLimit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits[prefix] = limit
+}
+
+func (q *QuotaManager) RemoveLimit(prefix string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.limits, prefix)
+	delete(q.usage, prefix)
+}
+
+func (q *QuotaManager) Limit(prefix string) (QuotaLimit, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit, ok := q.limits[prefix]
+	return limit, ok
+}
+
+func (q *QuotaManager) Usage(prefix string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage[prefix]
+}
+
+// Overwrites the running total, e.g. after counting the bucket contents
+func (q *QuotaManager) SetUsage(prefix string, usage QuotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage[prefix] = usage
+}
+
+// All the prefixes that have a limit, sorted
+func (q *QuotaManager) Prefixes() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	prefixes := make([]string, 0, len(q.limits))
+	for prefix := range q.limits {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// Adds delta to every prefix that contains the object.
+// When check is set, nothing changes if any of the limits would be exceeded.
+// Freeing up space (a negative delta) is always allowed
+func (q *QuotaManager) add(objectName string, delta QuotaUsage, check bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var prefixes []string
+	for prefix, limit := range q.limits {
+		if !strings.HasPrefix(objectName, prefix) {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+
+		if !check {
+			continue
+		}
+		usage := q.usage[prefix]
+		if exceeds(usage.Bytes, delta.Bytes, limit.MaxBytes) || exceeds(usage.Objects, delta.Objects, limit.MaxObjects) {
+			return &QuotaExceededError{
+				Prefix:    prefix,
+				Limit:     limit,
+				Usage:     usage,
+				Requested: delta,
+			}
+		}
+	}
+
+	for _, prefix := range prefixes {
+		usage := q.usage[prefix]
+		usage.Bytes += delta.Bytes
+		usage.Objects += delta.Objects
+		q.usage[prefix] = usage
+	}
+	return nil
+}
+
+// Moves an object's usage from one name to another.
+// Prefixes that contain both names don't change, so only the ones
+// gaining the object are checked against their limit
+func (q *QuotaManager) move(from, to string, size int64, check bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delta := QuotaUsage{Bytes: size, Objects: 1}
+
+	var gaining, losing []string
+	for prefix, limit := range q.limits {
+		inFrom, inTo := strings.HasPrefix(from, prefix), strings.HasPrefix(to, prefix)
+		switch {
+		case inTo && !inFrom:
+			usage := q.usage[prefix]
+			if check && (exceeds(usage.Bytes, delta.Bytes, limit.MaxBytes) || exceeds(usage.Objects, delta.Objects, limit.MaxObjects)) {
+				return &QuotaExceededError{
+					Prefix:    prefix,
+					Limit:     limit,
+					Usage:     usage,
+					Requested: delta,
+				}
+			}
+			gaining = append(gaining, prefix)
+		case inFrom && !inTo:
+			losing = append(losing, prefix)
+		}
+	}
+
+	for _, prefix := range gaining {
+		usage := q.usage[prefix]
+		usage.Bytes += delta.Bytes
+		usage.Objects += delta.Objects
+		q.usage[prefix] = usage
+	}
+	for _, prefix := range losing {
+		usage := q.usage[prefix]
+		usage.Bytes -= delta.Bytes
+		usage.Objects -= delta.Objects
+		q.usage[prefix] = usage
+	}
+	return nil
+}
+
+func exceeds(current, delta, limit int64) bool {
+	return limit > 0 && delta > 0 && current+delta > limit
+}
+
+// ===================================
+// WRITES
+// ===================================
+
+// Keeps track of what a single write has counted so far,
+// so that it can be corrected or undone once we know how it went.
+// A nil quotaWrite (no QuotaManager on the Store) does nothing
+type quotaWrite struct {
+	quota      *QuotaManager
+	objectName string
+	counted    QuotaUsage
+	replaced   int64
+}
+
+// Counts a write of size bytes to objectName, pass -1 if the size is unknown.
+// Writing over a live object doesn't add an object, and frees up its bytes once committed
+func (s *Store) startQuotaWrite(
+	ctx context.Context,
+	objectName string,
+	size int64,
+) (*quotaWrite, error) {
+	if s.Quota == nil {
+		return nil, nil
+	}
+
+	w := &quotaWrite{
+		quota:      s.Quota,
+		objectName: objectName,
+		counted:    QuotaUsage{Bytes: max(size, 0), Objects: 1},
+	}
+
+	attrsCtx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	existing, err := s.getObject(objectName).Attrs(attrsCtx)
+	switch {
+	case err == nil:
+		w.counted.Objects = 0
+		w.replaced = existing.Size
+	case !errors.Is(err, storage.ErrObjectNotExist):
+		return nil, fmt.Errorf("failed to check the quota for %s: %w", objectName, err)
+	}
+
+	if err := s.Quota.add(objectName, w.counted, true); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Counts the bytes as they are read, and fails the read as soon as we go over.
+// An upload that fails like this is never committed
+func (w *quotaWrite) reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &quotaReader{reader: r, write: w}
+}
+
+// The write landed, so make the numbers match what's actually in the bucket
+func (w *quotaWrite) commit(size int64) {
+	if w == nil {
+		return
+	}
+	w.quota.add(w.objectName, QuotaUsage{Bytes: size - w.counted.Bytes - w.replaced}, false)
+}
+
+// The write didn't happen, give back everything we counted
+func (w *quotaWrite) abort() {
+	if w == nil {
+		return
+	}
+	w.quota.add(w.objectName, QuotaUsage{Bytes: -w.counted.Bytes, Objects: -w.counted.Objects}, false)
+}
+
+type quotaReader struct {
+	reader io.Reader
+	write  *quotaWrite
+	read   int64
+}
+
+func (r *quotaReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.read += int64(n)
+
+	// Only count what goes past the size we were told about up front
+	if extra := r.read - r.write.counted.Bytes; extra > 0 {
+		if quotaErr := r.write.quota.add(r.write.objectName, QuotaUsage{Bytes: extra}, true); quotaErr != nil {
+			return 0, quotaErr
+		}
+		r.write.counted.Bytes += extra
+	}
+	return n, err
+}
+
+// Counts copying src to objectName. We need to know how big the source is first
+func (s *Store) startQuotaCopy(
+	ctx context.Context,
+	src *storage.ObjectHandle,
+	objectName string,
+) (*quotaWrite, error) {
+	if s.Quota == nil {
+		return nil, nil
+	}
+
+	attrsCtx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	srcAttrs, err := src.Attrs(attrsCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the quota for %s: %w", objectName, err)
+	}
+	return s.startQuotaWrite(ctx, objectName, srcAttrs.Size)
+}
+
+// Renames move usage between prefixes instead of adding to it, so renaming
+// a file inside a tenant that is at its limit still works.
+// Returns a function that undoes the move if the rename fails
+func (s *Store) startQuotaMove(
+	ctx context.Context,
+	src *storage.ObjectHandle,
+	objectName string,
+) (func(), error) {
+	if s.Quota == nil {
+		return func() {}, nil
+	}
+
+	attrsCtx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	srcAttrs, err := src.Attrs(attrsCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the quota for %s: %w", objectName, err)
+	}
+
+	if err := s.Quota.move(src.ObjectName(), objectName, srcAttrs.Size, true); err != nil {
+		return nil, err
+	}
+	return func() {
+		s.Quota.move(objectName, src.ObjectName(), srcAttrs.Size, false)
+	}, nil
+}
+
+// Frees up the space of an object that is no longer live
+func (s *Store) quotaRelease(objectName string, size int64) {
+	if s.Quota == nil {
+		return
+	}
+	s.Quota.add(objectName, QuotaUsage{Bytes: -size, Objects: -1}, false)
+}
+
+// ===================================
+// STORE HELPERS
+// ===================================
+
+// Limits the whole store (e.g. a tenant store) to the given usage
+func (s *Store) SetQuota(limit QuotaLimit) error {
+	if s.Quota == nil {
+		return errors.New("the store has no QuotaManager")
+	}
+	prefix, err := s.directoryPath("")
+	if err != nil {
+		return err
+	}
+	s.Quota.SetLimit(prefix, limit)
+	return nil
+}
+
+// How much of its quota the store is using
+func (s *Store) QuotaUsage() QuotaUsage {
+	if s.Quota == nil {
+		return QuotaUsage{}
+	}
+	prefix, _ := s.directoryPath("")
+	return s.Quota.Usage(prefix)
+}
+
+// Recounts every prefix with a limit under the BasePrefix by listing the bucket.
+// Writes that happen while we count can make the numbers drift a little,
+// which the next reconcile sorts out
+func (s *Store) ReconcileQuotas(ctx context.Context) error {
+	if s.Quota == nil {
+		return nil
+	}
+	root, err := s.directoryPath("")
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range s.Quota.Prefixes() {
+		if !strings.HasPrefix(prefix, root) {
+			continue
+		}
+
+		usage, err := s.countObjects(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile quota for %s: %w", prefix, err)
+		}
+		s.Quota.SetUsage(prefix, usage)
+	}
+	return nil
+}
+
+// Counts all the live objects under the prefix, recursively
+func (s *Store) countObjects(ctx context.Context, prefix string) (QuotaUsage, error) {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+		return QuotaUsage{}, err
+	}
+
+	var usage QuotaUsage
+	it := s.getBucket().Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+
+		// Directory placeholders aren't files, and parts of a parallel upload
+		// in flight will be gone soon
+		if strings.HasSuffix(attrs.Name, "/") || isCompositePart(s.BasePrefix, attrs.Name) {
+			continue
+		}
+		usage.Bytes += attrs.Size
+		usage.Objects++
+	}
+	return usage, nil
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestQuotaManager(t *testing.T) {
+	newManager := func() *QuotaManager {
+		q := NewQuotaManager()
+		q.SetLimit("tenant/acme/", QuotaLimit{MaxBytes: 100, MaxObjects: 3})
+		q.SetLimit("tenant/", QuotaLimit{MaxBytes: 150})
+		return q
+	}
+
+	t.Run("Counts every prefix that contains the object", func(t *testing.T) {
+		q := newManager()
+		if err := q.add("tenant/acme/a.txt", QuotaUsage{Bytes: 40, Objects: 1}, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := q.add("tenant/globex/b.txt", QuotaUsage{Bytes: 60, Objects: 1}, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := q.add("elsewhere/c.txt", QuotaUsage{Bytes: 1000, Objects: 1}, true); err != nil {
+			t.Fatalf("Objects outside every prefix are not limited: %v", err)
+		}
+
+		if usage := q.Usage("tenant/acme/"); usage != (QuotaUsage{Bytes: 40, Objects: 1}) {
+			t.Errorf("Unexpected acme usage: %+v", usage)
+		}
+		if usage := q.Usage("tenant/"); usage != (QuotaUsage{Bytes: 100, Objects: 2}) {
+			t.Errorf("Unexpected tenant usage: %+v", usage)
+		}
+	})
+
+	t.Run("Rejects writes over any limit", func(t *testing.T) {
+		q := newManager()
+		q.SetUsage("tenant/acme/", QuotaUsage{Bytes: 90, Objects: 1})
+		q.SetUsage("tenant/", QuotaUsage{Bytes: 140, Objects: 5})
+
+		err := q.add("tenant/acme/a.txt", QuotaUsage{Bytes: 20, Objects: 1}, true)
+		var quotaErr *QuotaExceededError
+		if !errors.As(err, &quotaErr) || !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected a quota error, got %v", err)
+		}
+
+		// The parent limit applies too
+		if err := q.add("tenant/globex/a.txt", QuotaUsage{Bytes: 20, Objects: 1}, true); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected the tenant limit to apply, got %v", err)
+		}
+
+		// Nothing changed
+		if usage := q.Usage("tenant/"); usage != (QuotaUsage{Bytes: 140, Objects: 5}) {
+			t.Errorf("Expected a rejected write to change nothing, got %+v", usage)
+		}
+
+		// Freeing space always works
+		if err := q.add("tenant/acme/a.txt", QuotaUsage{Bytes: -90, Objects: -1}, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Object limit", func(t *testing.T) {
+		q := newManager()
+		q.SetUsage("tenant/acme/", QuotaUsage{Objects: 3})
+		if err := q.add("tenant/acme/a.txt", QuotaUsage{Objects: 1}, true); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected the object limit to apply, got %v", err)
+		}
+		// Overwriting doesn't add an object
+		if err := q.add("tenant/acme/a.txt", QuotaUsage{Bytes: 5}, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Moves only check the prefixes that gain", func(t *testing.T) {
+		q := newManager()
+		q.SetUsage("tenant/acme/", QuotaUsage{Bytes: 100, Objects: 3})
+		q.SetUsage("tenant/", QuotaUsage{Bytes: 150, Objects: 4})
+
+		// Full, but renaming inside the tenant is fine
+		if err := q.move("tenant/acme/a.txt", "tenant/acme/b.txt", 50, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if usage := q.Usage("tenant/acme/"); usage != (QuotaUsage{Bytes: 100, Objects: 3}) {
+			t.Errorf("Expected the usage to stay the same, got %+v", usage)
+		}
+
+		// Moving out of the tenant frees up space
+		if err := q.move("tenant/acme/b.txt", "tenant/globex/b.txt", 50, true); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if usage := q.Usage("tenant/acme/"); usage != (QuotaUsage{Bytes: 50, Objects: 2}) {
+			t.Errorf("Expected the usage to go down, got %+v", usage)
+		}
+
+		// Moving back in has to fit
+		q.SetUsage("tenant/acme/", QuotaUsage{Bytes: 90, Objects: 2})
+		if err := q.move("tenant/globex/b.txt", "tenant/acme/b.txt", 50, true); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected a quota error, got %v", err)
+		}
+	})
+}
+
+func TestQuotaReader(t *testing.T) {
+	q := NewQuotaManager()
+	q.SetLimit("acme/", QuotaLimit{MaxBytes: 10})
+
+	t.Run("Stops reading when over the limit", func(t *testing.T) {
+		// As if startQuotaWrite counted the new object
+		q.SetUsage("acme/", QuotaUsage{Objects: 1})
+		w := &quotaWrite{quota: q, objectName: "acme/a.txt", counted: QuotaUsage{Objects: 1}}
+		_, err := io.Copy(io.Discard, w.reader(strings.NewReader("this is way more than ten bytes")))
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected a quota error, got %v", err)
+		}
+
+		w.abort()
+		if usage := q.Usage("acme/"); usage != (QuotaUsage{}) {
+			t.Errorf("Expected the aborted write to give everything back, got %+v", usage)
+		}
+	})
+
+	t.Run("Commit corrects the count", func(t *testing.T) {
+		w := &quotaWrite{quota: q, objectName: "acme/a.txt", counted: QuotaUsage{Objects: 1}, replaced: 2}
+		q.SetUsage("acme/", QuotaUsage{Bytes: 2, Objects: 1})
+
+		if _, err := io.Copy(io.Discard, w.reader(bytes.NewReader([]byte("12345")))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		w.commit(5)
+
+		// The old 2 bytes were replaced by the new 5
+		if usage := q.Usage("acme/"); usage != (QuotaUsage{Bytes: 5, Objects: 1}) {
+			t.Errorf("Unexpected usage: %+v", usage)
+		}
+	})
+
+	t.Run("Nil write does nothing", func(t *testing.T) {
+		var w *quotaWrite
+		r := strings.NewReader("abc")
+		if w.reader(r) != r {
+			t.Errorf("Expected the original reader")
+		}
+		w.commit(3)
+		w.abort()
+	})
+}
+
+func TestQuota(t *testing.T) {
+	h := NewTestHelper(t)
+	opts := DefaultStoreOptions()
+	opts.Quota = NewQuotaManager()
+	s := NewStoreWithOptions(h.Client, h.BucketName, h.TestPrefix, opts)
+
+	acme, _ := s.ForTenant("acme")
+	if err := acme.SetQuota(QuotaLimit{MaxBytes: 20, MaxObjects: 2}); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+
+	t.Run("Upload within the quota", func(t *testing.T) {
+		if _, err := acme.UploadFile(h.Context, strings.NewReader("0123456789"), "", "a.txt"); err != nil {
+			t.Fatalf("Failed to upload file: %v", err)
+		}
+		if usage := acme.QuotaUsage(); usage != (QuotaUsage{Bytes: 10, Objects: 1}) {
+			t.Errorf("Unexpected usage: %+v", usage)
+		}
+	})
+
+	t.Run("Upload over the quota", func(t *testing.T) {
+		// No size hint, so it has to be caught while streaming
+		reader := io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("0123456789!"))
+		_, err := acme.UploadFile(h.Context, reader, "", "b.txt")
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected a quota error, got %v", err)
+		}
+		if h.VerifyFile(acme.BasePrefix + "/b.txt") {
+			t.Fatalf("Upload over the quota should not have been committed")
+		}
+		if usage := acme.QuotaUsage(); usage != (QuotaUsage{Bytes: 10, Objects: 1}) {
+			t.Errorf("Expected the usage to be unchanged, got %+v", usage)
+		}
+	})
+
+	t.Run("Copy over the quota", func(t *testing.T) {
+		if _, err := acme.CopyObject(h.Context, "", "a.txt", "", "a-copy.txt"); err != nil {
+			t.Fatalf("Failed to copy file: %v", err)
+		}
+		if _, err := acme.CopyObject(h.Context, "", "a.txt", "", "a-copy-2.txt"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("Expected a quota error, got %v", err)
+		}
+	})
+
+	t.Run("Rename while full", func(t *testing.T) {
+		if err := acme.RenameObject(h.Context, "", "a-copy.txt", "", "renamed.txt"); err != nil {
+			t.Fatalf("Failed to rename file: %v", err)
+		}
+	})
+
+	t.Run("Delete frees up space", func(t *testing.T) {
+		if err := acme.DeleteObject(h.Context, "", "renamed.txt"); err != nil {
+			t.Fatalf("Failed to delete file: %v", err)
+		}
+		if usage := acme.QuotaUsage(); usage != (QuotaUsage{Bytes: 10, Objects: 1}) {
+			t.Errorf("Unexpected usage: %+v", usage)
+		}
+	})
+
+	t.Run("Reconcile", func(t *testing.T) {
+		opts.Quota.SetUsage(acme.BasePrefix+"/", QuotaUsage{Bytes: 1234, Objects: 99})
+		if err := s.ReconcileQuotas(h.Context); err != nil {
+			t.Fatalf("Failed to reconcile: %v", err)
+		}
+		if usage := acme.QuotaUsage(); usage != (QuotaUsage{Bytes: 10, Objects: 1}) {
+			t.Errorf("Expected the usage to match the bucket, got %+v", usage)
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// VERSION RETENTION
+// ===================================
+//
+// With versioning on (see EnableVersioning) nothing is ever really gone:
+// every delete and every overwrite leaves a noncurrent version behind, and
+// we pay for all of them, forever.
+//
+// A RetentionPolicy says how many versions to keep and for how long. There
+// are two ways to apply it:
+// 1) Let GCS do it: pass policy.LifecycleRules(...) to SetLifecycle
+// 2) Let the Store do it: PruneVersions, or SweepVersions in the background
+//
+// Both use the same conditions, so PruneVersions with dryRun also shows which
+// versions the lifecycle rules go after. Not exactly when though: PruneVersions
+// counts KeepDays as exact 24h periods, GCS counts whole days and applies the
+// rules on its own schedule, usually within a day
+// (https://cloud.google.com/storage/docs/lifecycle#behavior).
+// So a version in the report can stick around a day or two longer with GCS.
+// The live version is never pruned, only noncurrent ones.
+
+const DefaultRetentionSweepInterval = 24 * time.Hour
+
+var ErrInvalidRetention = errors.New("invalid retention policy")
+
+// Why a version got pruned
+const (
+	PruneReasonKeepLast = "keep_last"
+	PruneReasonKeepDays = "keep_days"
+)
+
+// A version is pruned as soon as it is past either limit. Zero means no limit
+type RetentionPolicy struct {
+	// Versions kept per object, the live one included.
+	// A deleted object has no live version, so it keeps this many noncurrent ones
+	KeepLast int
+
+	// Days a version is kept once it becomes noncurrent
+	KeepDays int
+}
+
+type PrunedVersion struct {
+	Name       string    `json:"name"` // Relative to the BasePrefix
+	Generation int64     `json:"generation"`
+	Size       int64     `json:"size"`
+	Noncurrent time.Time `json:"noncurrent"` // When it got deleted or overwritten
+	Reason     string    `json:"reason"`
+}
+
+type RetentionReport struct {
+	DryRun bool `json:"dry_run"`
+
+	// Versions looked at, live ones included
+	Scanned int `json:"scanned"`
+
+	Pruned      []PrunedVersion `json:"pruned"`
+	PrunedBytes int64           `json:"pruned_bytes"`
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.KeepLast < 0 || p.KeepDays < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidRetention)
+	}
+	if p.KeepLast == 0 && p.KeepDays == 0 {
+		return fmt.Errorf("%w: no limit, it would keep everything", ErrInvalidRetention)
+	}
+	return nil
+}
+
+// The bucket lifecycle rules that apply the policy to everything below prefix,
+// a full object name like "base/" ("" for the whole bucket).
+// SetLifecycle replaces all the rules, so add these to the ones you already have
+func (p RetentionPolicy) LifecycleRules(prefix string) ([]LifecycleRule, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	if prefix != "" {
+		matches = []string{prefix}
+	}
+
+	// GCS counts the live version as a newer version too, just like KeepLast does
+	var rules []LifecycleRule
+	if p.KeepLast > 0 {
+		rules = append(rules, LifecycleRule{
+			Action:           LifecycleDelete,
+			NumNewerVersions: int64(p.KeepLast),
+			Liveness:         storage.Archived,
+			MatchesPrefix:    matches,
+		})
+	}
+	if p.KeepDays > 0 {
+		rules = append(rules, LifecycleRule{
+			Action:              LifecycleDelete,
+			DaysSinceNoncurrent: int64(p.KeepDays),
+			Liveness:            storage.Archived,
+			MatchesPrefix:       matches,
+		})
+	}
+	return rules, nil
+}
+
+// Picks the versions the policy prunes. Pure, so it can be tested (and trusted)
+// without a bucket. The versions can be of any number of objects, in any order
+func (p RetentionPolicy) plan(versions []*storage.ObjectAttrs, now time.Time) []PrunedVersion {
+	byName := map[string][]*storage.ObjectAttrs{}
+	for _, attrs := range versions {
+		byName[attrs.Name] = append(byName[attrs.Name], attrs)
+	}
+
+	var pruned []PrunedVersion
+	for _, generations := range byName {
+		// Newest first, so the index is the number of newer versions
+		sort.Slice(generations, func(i, j int) bool {
+			return generations[i].Generation > generations[j].Generation
+		})
+
+		for newer, attrs := range generations {
+			// The live version has no deletion time
+			if attrs.Deleted.IsZero() {
+				continue
+			}
+
+			reason := ""
+			switch {
+			case p.KeepLast > 0 && newer >= p.KeepLast:
+				reason = PruneReasonKeepLast
+			case p.KeepDays > 0 && now.Sub(attrs.Deleted) >= time.Duration(p.KeepDays)*24*time.Hour:
+				reason = PruneReasonKeepDays
+			default:
+				continue
+			}
+
+			pruned = append(pruned, PrunedVersion{
+				Name:       attrs.Name,
+				Generation: attrs.Generation,
+				Size:       attrs.Size,
+				Noncurrent: attrs.Deleted,
+				Reason:     reason,
+			})
+		}
+	}
+
+	sort.Slice(pruned, func(i, j int) bool {
+		if pruned[i].Name != pruned[j].Name {
+			return pruned[i].Name < pruned[j].Name
+		}
+		return pruned[i].Generation > pruned[j].Generation
+	})
+	return pruned
+}
+
+// Deletes the noncurrent versions below the BasePrefix that the policy doesn't keep.
+// With dryRun nothing gets deleted, the report says what would have been.
+// On an error the report still has what was pruned until then
+func (s *Store) PruneVersions(
+	ctx context.Context,
+	policy RetentionPolicy,
+	dryRun bool,
+) (report RetentionReport, err error) {
+	report.DryRun = dryRun
+	if err := policy.validate(); err != nil {
+		return report, err
+	}
+
+	fullPrefix, err := s.directoryPath()
+	if err != nil {
+		return report, err
+	}
+
+	q := &storage.Query{Prefix: fullPrefix, Versions: true}
+	if err := q.SetAttrSelection([]string{"Name", "Generation", "Size", "Deleted"}); err != nil {
+		return report, err
+	}
+
+	// Planned at the start, so a long sweep treats every object the same
+	now := time.Now()
+
+	// The versions of an object are listed one after the other,
+	// so we only ever hold the versions of a single object
+	var current []*storage.ObjectAttrs
+	flush := func() error {
+		for _, version := range policy.plan(current, now) {
+			if !dryRun {
+				if err := s.pruneVersion(ctx, version.Name, version.Generation); err != nil {
+					return err
+				}
+			}
+			version.Name = strings.TrimPrefix(version.Name, fullPrefix)
+			report.Pruned = append(report.Pruned, version)
+			report.PrunedBytes += version.Size
+		}
+		current = current[:0]
+		return nil
+	}
+
+	it := s.getBucket().Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("error iterating versions: %v", err)
+		}
+
+		report.Scanned++
+		if len(current) > 0 && current[0].Name != attrs.Name {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+		current = append(current, attrs)
+	}
+	return report, flush()
+}
+
+// Deletes a single noncurrent version, for good
+func (s *Store) pruneVersion(ctx context.Context, objectPath string, generation int64) (err error) {
+	defer func() {
+		s.mutated(ctx, OperationPruneVersion, fmt.Sprintf("%s#%d", objectPath, generation), "", nil, err)
+	}()
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if err := s.getObject(objectPath).Generation(generation).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to prune generation %d of %s: %w", generation, objectPath, err)
+	}
+	return nil
+}
+
+// Runs PruneVersions right away and then every interval, until stop is called.
+// For when lifecycle rules aren't an option, e.g. the policy differs per tenant
+// and the bucket would need more than MaxLifecycleRules
+func (s *Store) SweepVersions(
+	policy RetentionPolicy,
+	interval time.Duration,
+	onError func(error),
+) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultRetentionSweepInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := s.PruneVersions(ctx, policy, false)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && onError != nil {
+				onError(err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestRetentionPlan(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+
+	// a.txt is live with 4 older versions, b.txt got deleted, c.txt has a single version
+	versions := []*storage.ObjectAttrs{
+		{Name: "base/a.txt", Generation: 5, Size: 50},
+		{Name: "base/b.txt", Generation: 2, Size: 2, Deleted: daysAgo(1)},
+		{Name: "base/a.txt", Generation: 1, Size: 10, Deleted: daysAgo(40)},
+		{Name: "base/a.txt", Generation: 4, Size: 40, Deleted: daysAgo(2)},
+		{Name: "base/b.txt", Generation: 1, Size: 1, Deleted: daysAgo(10)},
+		{Name: "base/a.txt", Generation: 3, Size: 30, Deleted: daysAgo(5)},
+		{Name: "base/a.txt", Generation: 2, Size: 20, Deleted: daysAgo(30)},
+		{Name: "base/c.txt", Generation: 1, Size: 100},
+	}
+
+	type pruned struct {
+		name       string
+		generation int64
+		reason     string
+	}
+	tests := []struct {
+		policy   RetentionPolicy
+		expected []pruned
+	}{
+		{RetentionPolicy{KeepLast: 1}, []pruned{
+			{"base/a.txt", 4, PruneReasonKeepLast},
+			{"base/a.txt", 3, PruneReasonKeepLast},
+			{"base/a.txt", 2, PruneReasonKeepLast},
+			{"base/a.txt", 1, PruneReasonKeepLast},
+			{"base/b.txt", 1, PruneReasonKeepLast},
+		}},
+		{RetentionPolicy{KeepLast: 3}, []pruned{
+			{"base/a.txt", 2, PruneReasonKeepLast},
+			{"base/a.txt", 1, PruneReasonKeepLast},
+		}},
+		{RetentionPolicy{KeepDays: 30}, []pruned{
+			{"base/a.txt", 2, PruneReasonKeepDays},
+			{"base/a.txt", 1, PruneReasonKeepDays},
+		}},
+		// Past either limit is enough
+		{RetentionPolicy{KeepLast: 4, KeepDays: 7}, []pruned{
+			{"base/a.txt", 2, PruneReasonKeepDays},
+			{"base/a.txt", 1, PruneReasonKeepLast},
+			{"base/b.txt", 1, PruneReasonKeepDays},
+		}},
+		{RetentionPolicy{KeepLast: 10, KeepDays: 100}, nil},
+	}
+
+	for _, test := range tests {
+		var got []pruned
+		for _, version := range test.policy.plan(versions, now) {
+			got = append(got, pruned{version.Name, version.Generation, version.Reason})
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.policy, test.expected, got)
+		}
+	}
+}
+
+// The lifecycle rules and the sweeper have to use the same conditions
+func TestRetentionLifecycleRules(t *testing.T) {
+	tests := []struct {
+		policy   RetentionPolicy
+		prefix   string
+		expected []LifecycleRule
+	}{
+		{RetentionPolicy{KeepLast: 3}, "base/", []LifecycleRule{
+			{Action: LifecycleDelete, NumNewerVersions: 3, Liveness: storage.Archived, MatchesPrefix: []string{"base/"}},
+		}},
+		{RetentionPolicy{KeepDays: 30}, "", []LifecycleRule{
+			{Action: LifecycleDelete, DaysSinceNoncurrent: 30, Liveness: storage.Archived},
+		}},
+		{RetentionPolicy{KeepLast: 5, KeepDays: 90}, "base/tenant/acme/", []LifecycleRule{
+			{Action: LifecycleDelete, NumNewerVersions: 5, Liveness: storage.Archived, MatchesPrefix: []string{"base/tenant/acme/"}},
+			{Action: LifecycleDelete, DaysSinceNoncurrent: 90, Liveness: storage.Archived, MatchesPrefix: []string{"base/tenant/acme/"}},
+		}},
+	}
+
+	for _, test := range tests {
+		rules, err := test.policy.LifecycleRules(test.prefix)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", test.policy, err)
+		}
+		if !reflect.DeepEqual(rules, test.expected) {
+			t.Errorf("%+v: expected %+v, got %+v", test.policy, test.expected, rules)
+		}
+		if _, err := toLifecycle(rules); err != nil {
+			t.Errorf("%+v: the rules are invalid: %v", test.policy, err)
+		}
+	}
+
+	for _, policy := range []RetentionPolicy{{}, {KeepLast: -1}, {KeepDays: -1, KeepLast: 1}} {
+		if _, err := policy.LifecycleRules(""); !errors.Is(err, ErrInvalidRetention) {
+			t.Errorf("%+v: expected an invalid policy, got %v", policy, err)
+		}
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+
+	h.EnableVersioning()
+
+	// Three overwrites leave three noncurrent versions behind
+	for i := range 4 {
+		if _, err := s.UploadFile(h.Context, bytes.NewReader(fmt.Appendf(nil, "version %d", i)), "", "notes.txt"); err != nil {
+			t.Fatalf("Failed to upload version %d: %v", i, err)
+		}
+	}
+
+	policy := RetentionPolicy{KeepLast: 2}
+	report, err := s.PruneVersions(h.Context, policy, true)
+	if err != nil {
+		t.Fatalf("Failed to plan the pruning: %v", err)
+	}
+	if !report.DryRun || len(report.Pruned) != 2 || report.PrunedBytes != 2*int64(len("version 0")) {
+		t.Fatalf("Expected 2 versions to be pruned, got %+v", report)
+	}
+
+	versions, err := s.ListObjectVersions(h.Context, "", "notes.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 4 {
+		t.Fatalf("A dry run deleted something, %d versions left", len(versions))
+	}
+
+	report, err = s.PruneVersions(h.Context, policy, false)
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if len(report.Pruned) != 2 || report.Pruned[0].Name != "notes.txt" {
+		t.Fatalf("Expected 2 versions of notes.txt to be pruned, got %+v", report)
+	}
+
+	versions, err = s.ListObjectVersions(h.Context, "", "notes.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 2 || !versions[0].Deleted.IsZero() {
+		t.Errorf("Expected the live version and the last one to be left, got %d", len(versions))
+	}
+}
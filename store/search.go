@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ===================================
+// SEARCH
+// ===================================
+//
+// Users can't find a file unless they know its folder. GCS has no search,
+// only listings by prefix, so we list everything below the prefix (no
+// delimiter, so the subdirectories too) and match the names as we go.
+//
+// That gets expensive on big buckets, so a single call never looks at more
+// than MaxScanned objects. When it stops early, hasMore is true and the cursor
+// continues the scan where it left off, even if the page isn't full. The UI
+// can show what it has and offer "search further".
+
+const DefaultSearchMaxScanned = 10_000
+
+var ErrInvalidQuery = errors.New("invalid search query")
+
+type SearchOptions struct {
+	// Matches per page. Defaults to DefaultListLimit
+	Limit int
+
+	// Objects looked at per call. Defaults to DefaultSearchMaxScanned
+	MaxScanned int
+
+	// From the previous page. Empty for the first page.
+	// Only valid with the same prefix it came from
+	Cursor string
+
+	// Called for every match as soon as it's found, e.g. to push it over SSE
+	// while the scan is still going. The page is returned all the same
+	OnMatch func(ObjectInfo)
+}
+
+// Finds the files and directories below prefix whose name matches the query.
+// Only the name is matched, not the directories it's in. The query is either
+// a substring, or a glob if it has any of *?[ (see path.Match).
+// Both are case-insensitive.
+//
+// The names returned are relative to prefix, e.g. "2024/report.pdf"
+func (s *Store) SearchObjects(
+	ctx context.Context,
+	prefix, query string,
+	opts SearchOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	fullPrefix, err := s.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return s.search(ctx, s.objectSource(), fullPrefix, query, opts, nil)
+}
+
+// keep filters the matches, nil keeps everything
+func (s *Store) search(
+	ctx context.Context,
+	src objectSource,
+	fullPrefix, query string,
+	opts SearchOptions,
+	keep func(ObjectInfo) bool,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	match, err := searchMatcher(query)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return s.scan(ctx, src, fullPrefix, opts, func(entry ObjectInfo) bool {
+		return match(path.Base(entry.Name)) && (keep == nil || keep(entry))
+	})
+}
+
+// Goes through everything below the prefix, a page of matches at a time.
+// The cursor and the cap work the same for anything we look for
+func (s *Store) scan(
+	ctx context.Context,
+	src objectSource,
+	fullPrefix string,
+	opts SearchOptions,
+	match func(ObjectInfo) bool,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	q := &storage.Query{Prefix: fullPrefix}
+	if opts.Cursor != "" {
+		// Inclusive, the object the cursor points at gets skipped below
+		q.StartOffset = fullPrefix + opts.Cursor
+	}
+	if err := q.SetAttrSelection([]string{"Name", "Size", "Created", "Updated", "Metadata"}); err != nil {
+		return nil, "", false, err
+	}
+
+	limit := opts.limit()
+	maxScanned := opts.maxScanned()
+	scanned := 0
+
+	it := src.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, "", false, nil
+		}
+		if err != nil {
+			return nil, "", false, fmt.Errorf("error iterating objects: %v", err)
+		}
+
+		name := strings.TrimPrefix(attrs.Name, fullPrefix)
+		if name == "" || (opts.Cursor != "" && name <= opts.Cursor) {
+			continue
+		}
+
+		// There is at least one more to look at
+		if len(objects) == limit || scanned == maxScanned {
+			return objects, nextCursor, true, nil
+		}
+		scanned++
+		nextCursor = name
+
+		if isCompositePart(s.BasePrefix, attrs.Name) {
+			continue
+		}
+
+		// Directories are just empty objects with a trailing slash
+		entry := ObjectInfo{
+			Name:              strings.TrimSuffix(name, "/"),
+			IsDir:             strings.HasSuffix(name, "/"),
+			Size:              attrs.Size,
+			HumanReadableSize: FormatBytes(attrs.Size),
+			Created:           attrs.Created,
+			Updated:           attrs.Updated,
+			Tags:              tagsFromMetadata(attrs.Metadata),
+		}
+		if entry.IsDir {
+			entry.HumanReadableSize = ""
+		}
+		if !match(entry) {
+			continue
+		}
+
+		objects = append(objects, entry)
+		if opts.OnMatch != nil {
+			opts.OnMatch(entry)
+		}
+	}
+}
+
+// Glob or substring, case-insensitive
+func searchMatcher(query string) (func(name string) bool, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, fmt.Errorf("%w: empty query", ErrInvalidQuery)
+	}
+
+	if !strings.ContainsAny(query, "*?[") {
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), query)
+		}, nil
+	}
+
+	if _, err := path.Match(query, ""); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(query, strings.ToLower(name))
+		return ok
+	}, nil
+}
+
+func (o SearchOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return o.Limit
+}
+
+func (o SearchOptions) maxScanned() int {
+	if o.MaxScanned <= 0 {
+		return DefaultSearchMaxScanned
+	}
+	return o.MaxScanned
+}
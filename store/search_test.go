@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSearchMatcher(t *testing.T) {
+	tests := []struct {
+		query    string
+		name     string
+		expected bool
+	}{
+		{"report", "Annual-Report.pdf", true},
+		{"REPORT", "annual-report.pdf", true},
+		{"  report ", "report.pdf", true},
+		{"report", "notes.txt", false},
+		{"*.pdf", "Annual-Report.PDF", true},
+		{"*.pdf", "report.pdf.txt", false},
+		{"report-202?.pdf", "report-2024.pdf", true},
+		{"[ab]*", "Budget.xlsx", true},
+		{"[ab]*", "costs.xlsx", false},
+	}
+
+	for _, test := range tests {
+		match, err := searchMatcher(test.query)
+		if err != nil {
+			t.Errorf("searchMatcher(%q): unexpected error: %v", test.query, err)
+			continue
+		}
+		if result := match(test.name); result != test.expected {
+			t.Errorf("searchMatcher(%q)(%q): expected %v, got %v", test.query, test.name, test.expected, result)
+		}
+	}
+
+	for _, query := range []string{"", "   ", "[a-"} {
+		if _, err := searchMatcher(query); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("searchMatcher(%q): expected an invalid query, got %v", query, err)
+		}
+	}
+}
+
+func TestSearchObjects(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	src := fakeSource{names: []string{
+		"base/",
+		"base/report.pdf",
+		"base/2023/",
+		"base/2023/Report-Q1.pdf",
+		"base/2023/notes.txt",
+		"base/2024/reports/",
+		"base/2024/reports/q2.pdf",
+		"base/2024/reports/q2-report.PDF",
+		"base/other.txt",
+		"base/" + compositeTempDir + "/report.part-1",
+	}}
+	search := func(query string, opts SearchOptions) ([]ObjectInfo, string, bool) {
+		t.Helper()
+		objects, cursor, hasMore, err := s.search(context.Background(), src, "base/", query, opts, nil)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", query, err)
+		}
+		return objects, cursor, hasMore
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"report", []string{"2023/Report-Q1.pdf", "2024/reports/", "2024/reports/q2-report.PDF", "report.pdf"}},
+		{"*.pdf", []string{"2023/Report-Q1.pdf", "2024/reports/q2-report.PDF", "2024/reports/q2.pdf", "report.pdf"}},
+		{"2023", []string{"2023/"}},
+		{"part", nil},
+	}
+
+	for _, test := range tests {
+		objects, _, hasMore := search(test.query, SearchOptions{})
+		if names := listNames(objects); !slices.Equal(names, test.expected) || hasMore {
+			t.Errorf("%q: expected %q, got %q (hasMore: %v)", test.query, test.expected, names, hasMore)
+		}
+	}
+
+	t.Run("Pages and scan caps don't lose matches", func(t *testing.T) {
+		expected, _, _ := search("r", SearchOptions{})
+
+		for limit := 1; limit <= len(expected)+1; limit++ {
+			for maxScanned := 1; maxScanned <= len(src.names); maxScanned++ {
+				var found, streamed []ObjectInfo
+				opts := SearchOptions{
+					Limit:      limit,
+					MaxScanned: maxScanned,
+					OnMatch:    func(obj ObjectInfo) { streamed = append(streamed, obj) },
+				}
+
+				for calls := 0; ; calls++ {
+					if calls > len(src.names) {
+						t.Fatalf("limit %d, max scanned %d: the search never ends", limit, maxScanned)
+					}
+					objects, cursor, hasMore := search("r", opts)
+					if len(objects) > limit {
+						t.Fatalf("limit %d, max scanned %d: got a page of %d", limit, maxScanned, len(objects))
+					}
+					found = append(found, objects...)
+					if !hasMore {
+						break
+					}
+					opts.Cursor = cursor
+				}
+
+				if !slices.Equal(listNames(found), listNames(expected)) {
+					t.Errorf("limit %d, max scanned %d: expected %q, got %q", limit, maxScanned, listNames(expected), listNames(found))
+				}
+				if !slices.Equal(listNames(streamed), listNames(found)) {
+					t.Errorf("limit %d, max scanned %d: streamed %q, returned %q", limit, maxScanned, listNames(streamed), listNames(found))
+				}
+			}
+		}
+	})
+
+	t.Run("Stops at the scan cap", func(t *testing.T) {
+		// Our temporary parts count too, ".composite/" sorts first
+		objects, cursor, hasMore := search("notes", SearchOptions{MaxScanned: 3})
+		if len(objects) != 0 || !hasMore || cursor != "2023/Report-Q1.pdf" {
+			t.Errorf("Expected an empty page to continue after %q, got %q at %q (hasMore: %v)", "2023/Report-Q1.pdf", listNames(objects), cursor, hasMore)
+		}
+	})
+}
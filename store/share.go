@@ -0,0 +1,378 @@
+package store
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// SHARE LINKS
+// ===================================
+//
+// Let people outside the system download a file, or anything in a folder,
+// without an account. A share link is a random token that maps to a path in
+// the store, and the handler streams the download through the store.
+//
+// Unlike signed URLs (signed_url.go), a share link can be revoked, limited to
+// a number of downloads and protected with a password, since every download
+// goes through us.
+//
+// The links live in memory, so they are gone after a restart.
+// We only keep a hash of the token, so dumping the links doesn't leak them.
+
+const (
+	DefaultShareExpiry = 7 * 24 * time.Hour
+
+	// PBKDF2-HMAC-SHA256, as recommended by OWASP
+	// https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html#pbkdf2
+	sharePasswordIterations = 600_000
+	sharePasswordKeyLength  = 32
+)
+
+var (
+	ErrShareNotFound      = errors.New("share link not found")
+	ErrShareExpired       = errors.New("share link expired")
+	ErrShareRevoked       = errors.New("share link revoked")
+	ErrShareLimitReached  = errors.New("share link download limit reached")
+	ErrSharePasswordWrong = errors.New("share link password is wrong")
+)
+
+type ShareOptions struct {
+	// How long the link stays valid. Defaults to DefaultShareExpiry
+	Expires time.Duration
+
+	// Optional. Has to be sent along with every download
+	Password string
+
+	// Zero means no limit
+	MaxDownloads int
+}
+
+type ShareLink struct {
+	// Only set when the link is created. Hand it to the user, we can't get it back
+	Token string `json:"token,omitempty"`
+
+	ID           string    `json:"id"`
+	Prefix       string    `json:"prefix"`
+	Name         string    `json:"name"` // Empty for a folder
+	CreatedBy    string    `json:"created_by"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"`
+	Downloads    int       `json:"downloads"`
+	Revoked      bool      `json:"revoked"`
+	HasPassword  bool      `json:"has_password"`
+
+	passwordSalt []byte
+	passwordHash []byte
+}
+
+func (l *ShareLink) IsDir() bool {
+	return l.Name == ""
+}
+
+// Safe for concurrent use
+type ShareManager struct {
+	Store *Store
+
+	mu    sync.Mutex
+	links map[string]*ShareLink // token hash -> link
+	now   func() time.Time
+}
+
+func NewShareManager(s *Store) *ShareManager {
+	return &ShareManager{
+		Store: s,
+		links: map[string]*ShareLink{},
+		now:   time.Now,
+	}
+}
+
+// Shares a single file. Fails if the file doesn't exist
+func (m *ShareManager) ShareFile(
+	ctx context.Context,
+	prefix, filename string,
+	opts ShareOptions,
+) (*ShareLink, error) {
+	objectPath, err := m.Store.objectPath(prefix, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := m.Store.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := m.Store.getObject(objectPath).Attrs(ctx); err != nil {
+		return nil, fmt.Errorf("failed to share %s: %w", objectPath, err)
+	}
+
+	// Keep the paths relative to the store, like everything else
+	relativePath, _ := CleanPath(prefix, filename)
+	return m.create(ctx, parentPath(relativePath), path.Base(relativePath), opts)
+}
+
+// Shares everything in the folder, including subfolders
+func (m *ShareManager) ShareFolder(
+	ctx context.Context,
+	prefix string,
+	opts ShareOptions,
+) (*ShareLink, error) {
+	if _, err := m.Store.directoryPath(prefix); err != nil {
+		return nil, err
+	}
+	relativePath, _ := CleanPath(prefix)
+	return m.create(ctx, relativePath, "", opts)
+}
+
+func (m *ShareManager) create(
+	ctx context.Context,
+	prefix, name string,
+	opts ShareOptions,
+) (*ShareLink, error) {
+	expires := opts.Expires
+	if expires == 0 {
+		expires = DefaultShareExpiry
+	}
+	if expires < 0 {
+		return nil, fmt.Errorf("share link expiry must be positive, got %v", expires)
+	}
+	if opts.MaxDownloads < 0 {
+		return nil, fmt.Errorf("share link download limit must be positive, got %d", opts.MaxDownloads)
+	}
+
+	token := rand.Text()
+	createdBy, _ := PrincipalFromContext(ctx)
+	now := m.now()
+
+	link := &ShareLink{
+		ID:           shareID(token),
+		Prefix:       prefix,
+		Name:         name,
+		CreatedBy:    createdBy,
+		Created:      now,
+		Expires:      now.Add(expires),
+		MaxDownloads: opts.MaxDownloads,
+	}
+
+	if opts.Password != "" {
+		link.passwordSalt = make([]byte, 16)
+		rand.Read(link.passwordSalt)
+
+		hash, err := hashSharePassword(opts.Password, link.passwordSalt)
+		if err != nil {
+			return nil, err
+		}
+		link.passwordHash = hash
+		link.HasPassword = true
+	}
+
+	m.mu.Lock()
+	m.links[link.ID] = link
+	m.mu.Unlock()
+
+	result := *link
+	result.Token = token
+	return &result, nil
+}
+
+// The link behind the token, whatever state it's in
+func (m *ShareManager) Get(token string) (*ShareLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[shareID(token)]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+	result := *link
+	return &result, nil
+}
+
+// Stops the link from working. The ID is in the link returned by Get and ShareFile/ShareFolder
+func (m *ShareManager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[id]
+	if !ok {
+		return ErrShareNotFound
+	}
+	link.Revoked = true
+	return nil
+}
+
+// Drops expired and revoked links. Call it every now and then
+func (m *ShareManager) Prune() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	pruned := 0
+	for id, link := range m.links {
+		if link.Revoked || now.After(link.Expires) {
+			delete(m.links, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Checks the token and password, and counts a download.
+// Returns the prefix and filename to download. For folders, filePath is the
+// path of the file inside the folder. It can't leave the folder, CleanPath makes sure of that
+func (m *ShareManager) resolve(token, password, filePath string) (prefix, filename string, undo func(), err error) {
+	// A dead link fails before the password is hashed, otherwise every
+	// request for it would still cost a full hash
+	m.mu.Lock()
+	link, ok := m.links[shareID(token)]
+	if ok {
+		err = m.usable(link)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return "", "", nil, ErrShareNotFound
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	// Hashing is slow on purpose, so we do it without holding the lock.
+	// The password never changes after the link is created
+	if link.HasPassword {
+		hash, err := hashSharePassword(password, link.passwordSalt)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if subtle.ConstantTimeCompare(hash, link.passwordHash) != 1 {
+			return "", "", nil, ErrSharePasswordWrong
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Again, the link could have been revoked or used up while we were hashing
+	if err := m.usable(link); err != nil {
+		return "", "", nil, err
+	}
+
+	if link.IsDir() {
+		filePath, err = CleanPath(filePath)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if filePath == "" {
+			return "", "", nil, &InvalidPathError{Path: filePath, Reason: "a file inside the shared folder is required"}
+		}
+		prefix, filename = path.Join(link.Prefix, parentPath(filePath)), path.Base(filePath)
+	} else {
+		if filePath != "" {
+			return "", "", nil, ErrShareNotFound
+		}
+		prefix, filename = link.Prefix, link.Name
+	}
+
+	// Reserve the download now, so concurrent downloads can't go over the limit
+	link.Downloads++
+	undo = func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		link.Downloads--
+	}
+	return prefix, filename, undo, nil
+}
+
+// Whether the link can still be downloaded from. The caller holds the lock
+func (m *ShareManager) usable(link *ShareLink) error {
+	if link.Revoked {
+		return ErrShareRevoked
+	}
+	if m.now().After(link.Expires) {
+		return ErrShareExpired
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return ErrShareLimitReached
+	}
+	return nil
+}
+
+// ===================================
+// HTTP
+// ===================================
+
+// Serves GET /{token} for files and GET /{token}/{path...} for folders.
+// Mount it under its own path, e.g.
+// mux.Handle("/s/", http.StripPrefix("/s", shares.Handler()))
+//
+// The password is sent with basic auth (any username), so browsers prompt for it
+func (m *ShareManager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{token}", m.serveDownload)
+	mux.HandleFunc("GET /{token}/{path...}", m.serveDownload)
+	return mux
+}
+
+func (m *ShareManager) serveDownload(w http.ResponseWriter, r *http.Request) {
+	_, password, _ := r.BasicAuth()
+
+	prefix, filename, undo, err := m.resolve(r.PathValue("token"), password, r.PathValue("path"))
+	if err != nil {
+		if errors.Is(err, ErrSharePasswordWrong) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="share"`)
+		}
+		http.Error(w, err.Error(), shareStatusCode(err))
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	written, err := m.Store.DownloadFile(r.Context(), w, prefix, filename)
+	if err != nil && written == 0 {
+		// Nothing was sent yet, so it doesn't count and we can still report it
+		undo()
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "failed to download file", shareStatusCode(err))
+	}
+}
+
+func shareStatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrShareNotFound), errors.Is(err, storage.ErrObjectNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrShareExpired), errors.Is(err, ErrShareRevoked), errors.Is(err, ErrShareLimitReached):
+		return http.StatusGone
+	case errors.Is(err, ErrSharePasswordWrong):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrInvalidPath):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func shareID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func hashSharePassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, sharePasswordKeyLength)
+}
@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestShareLinks(t *testing.T) {
+	newManager := func() *ShareManager {
+		return NewShareManager(NewStore(nil, "bucket", "base"))
+	}
+	ctx := context.Background()
+
+	t.Run("File links resolve to the file", func(t *testing.T) {
+		m := newManager()
+		link, err := m.create(WithPrincipal(ctx, "alice"), "reports", "q3.pdf", ShareOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if link.Token == "" || link.CreatedBy != "alice" {
+			t.Fatalf("Unexpected link: %+v", link)
+		}
+		if got := link.Expires.Sub(link.Created); got != DefaultShareExpiry {
+			t.Errorf("Expected the default expiry, got %v", got)
+		}
+
+		prefix, filename, _, err := m.resolve(link.Token, "", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if prefix != "reports" || filename != "q3.pdf" {
+			t.Errorf("Expected reports/q3.pdf, got %s/%s", prefix, filename)
+		}
+
+		if _, _, _, err := m.resolve(link.Token, "", "other.pdf"); !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("Expected a file link to only serve the file, got %v", err)
+		}
+	})
+
+	t.Run("Folder links stay inside the folder", func(t *testing.T) {
+		m := newManager()
+		link, _ := m.create(ctx, "reports", "", ShareOptions{})
+
+		tests := []struct {
+			filePath string
+			prefix   string
+			filename string
+		}{
+			{"q3.pdf", "reports", "q3.pdf"},
+			{"2026/q1.pdf", "reports/2026", "q1.pdf"},
+			{"2026/../q2.pdf", "reports", "q2.pdf"},
+		}
+		for _, test := range tests {
+			prefix, filename, _, err := m.resolve(link.Token, "", test.filePath)
+			if err != nil {
+				t.Errorf("resolve(%q): unexpected error: %v", test.filePath, err)
+				continue
+			}
+			if prefix != test.prefix || filename != test.filename {
+				t.Errorf("resolve(%q): expected %s/%s, got %s/%s", test.filePath, test.prefix, test.filename, prefix, filename)
+			}
+		}
+
+		for _, filePath := range []string{"", "../secret.txt", "2026/../../secret.txt"} {
+			if _, _, _, err := m.resolve(link.Token, "", filePath); !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("resolve(%q): expected an invalid path, got %v", filePath, err)
+			}
+		}
+	})
+
+	t.Run("Expired, revoked and unknown links", func(t *testing.T) {
+		m := newManager()
+		expired, _ := m.create(ctx, "", "a.txt", ShareOptions{Expires: time.Hour})
+		revoked, _ := m.create(ctx, "", "b.txt", ShareOptions{})
+		m.Revoke(revoked.ID)
+
+		now := time.Now()
+		m.now = func() time.Time { return now.Add(2 * time.Hour) }
+
+		if _, _, _, err := m.resolve(expired.Token, "", ""); !errors.Is(err, ErrShareExpired) {
+			t.Errorf("Expected an expired link, got %v", err)
+		}
+		if _, _, _, err := m.resolve(revoked.Token, "", ""); !errors.Is(err, ErrShareRevoked) {
+			t.Errorf("Expected a revoked link, got %v", err)
+		}
+		if _, _, _, err := m.resolve("made-up", "", ""); !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("Expected an unknown link, got %v", err)
+		}
+
+		if pruned := m.Prune(); pruned != 2 {
+			t.Errorf("Expected both links to be pruned, got %d", pruned)
+		}
+	})
+
+	t.Run("Download limit", func(t *testing.T) {
+		m := newManager()
+		link, _ := m.create(ctx, "", "a.txt", ShareOptions{MaxDownloads: 1})
+
+		_, _, undo, err := m.resolve(link.Token, "", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, _, _, err := m.resolve(link.Token, "", ""); !errors.Is(err, ErrShareLimitReached) {
+			t.Fatalf("Expected the limit to be reached, got %v", err)
+		}
+
+		// A failed download gives the download back
+		undo()
+		if _, _, _, err := m.resolve(link.Token, "", ""); err != nil {
+			t.Fatalf("Expected the download to be available again, got %v", err)
+		}
+	})
+
+	t.Run("Password", func(t *testing.T) {
+		m := newManager()
+		link, _ := m.create(ctx, "", "a.txt", ShareOptions{Password: "hunter2"})
+		if !link.HasPassword || len(link.passwordHash) == 0 {
+			t.Fatalf("Expected the password to be hashed")
+		}
+
+		if _, _, _, err := m.resolve(link.Token, "hunter3", ""); !errors.Is(err, ErrSharePasswordWrong) {
+			t.Errorf("Expected a wrong password, got %v", err)
+		}
+		if _, _, _, err := m.resolve(link.Token, "hunter2", ""); err != nil {
+			t.Errorf("Expected the right password to work, got %v", err)
+		}
+
+		// A dead link fails before the password gets hashed
+		m.Revoke(link.ID)
+		if _, _, _, err := m.resolve(link.Token, "hunter3", ""); !errors.Is(err, ErrShareRevoked) {
+			t.Errorf("Expected a revoked link, got %v", err)
+		}
+	})
+}
+
+func TestShareHandlerErrors(t *testing.T) {
+	m := NewShareManager(NewStore(nil, "bucket", "base"))
+	ctx := context.Background()
+
+	revoked, _ := m.create(ctx, "", "a.txt", ShareOptions{})
+	m.Revoke(revoked.ID)
+	folder, _ := m.create(ctx, "reports", "", ShareOptions{})
+
+	tests := []struct {
+		target   string
+		expected int
+	}{
+		{"/made-up", http.StatusNotFound},
+		{"/" + revoked.Token, http.StatusGone},
+		{"/" + folder.Token + "/..%2Fsecret.txt", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if rec.Code != test.expected {
+			t.Errorf("GET %s: expected %d, got %d", test.target, test.expected, rec.Code)
+		}
+	}
+}
+
+func TestGuardedShareNeedsTheGuardedStore(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	acme, _ := s.ForTenant("acme")
+
+	p := NewPolicy()
+	p.Grant("alice", "", PermissionAll)
+	g := NewGuardedStore(acme, p)
+	alice := WithPrincipal(context.Background(), "alice")
+
+	// alice can share anything of acme, which doesn't make her the owner of the parent
+	if _, err := g.ShareFolder(alice, NewShareManager(s), "reports", ShareOptions{}); !errors.Is(err, ErrStoreMismatch) {
+		t.Errorf("Expected a store mismatch, got %v", err)
+	}
+	if _, err := g.ShareFile(alice, NewShareManager(s), "reports", "q3.pdf", ShareOptions{}); !errors.Is(err, ErrStoreMismatch) {
+		t.Errorf("Expected a store mismatch, got %v", err)
+	}
+
+	if _, err := g.ShareFolder(alice, NewShareManager(acme), "reports", ShareOptions{}); err != nil {
+		t.Errorf("Expected a manager of the tenant to work, got %v", err)
+	}
+}
+
+func TestShareDownload(t *testing.T) {
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+	m := NewShareManager(s)
+
+	const contents = "quarterly numbers"
+	if _, err := s.UploadFile(h.Context, bytes.NewReader([]byte(contents)), "reports", "q3.txt"); err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	link, err := m.ShareFile(h.Context, "reports", "q3.txt", ShareOptions{MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("Failed to share file: %v", err)
+	}
+
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/" + link.Token)
+	if err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != contents {
+		t.Fatalf("Expected the file contents, got %d: %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(server.URL + "/" + link.Token)
+	if err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected the download limit to kick in, got %d", resp.StatusCode)
+	}
+
+	if _, err := m.ShareFile(h.Context, "reports", "missing.txt", ShareOptions{}); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("Expected sharing a missing file to fail, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// SIGNED URLS
+// ===================================
+//
+// Proxying every byte through our service is expensive.
+// Instead, we check if the user is allowed to do something, and then hand
+// them a URL that lets them talk to GCS directly for a little while.
+// https://cloud.google.com/storage/docs/access-control/signed-urls
+// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_BucketHandle_SignedURL
+//
+// The client has to send the exact headers we signed, otherwise GCS
+// rejects the request. That's how the content type and size are enforced.
+
+const (
+	DefaultSignedURLExpiry = 15 * time.Minute
+
+	// V4 signatures can't live longer than a week
+	MaxSignedURLExpiry = 7 * 24 * time.Hour
+)
+
+// How the URLs get signed. When left empty the library works it out from the
+// client's credentials, either using the service account key or by asking the
+// IAM API to sign for us (which needs the iam.serviceAccounts.signBlob permission)
+// https://pkg.go.dev/cloud.google.com/go/storage#hdr-Credential_requirements_for_signing
+type SigningOptions struct {
+	GoogleAccessID string
+	PrivateKey     []byte
+	SignBytes      func([]byte) ([]byte, error)
+}
+
+type SignedURLOptions struct {
+	// How long the URL stays valid. Defaults to DefaultSignedURLExpiry
+	Expires time.Duration
+
+	// Uploads only: the content type the client has to upload with
+	ContentType string
+
+	// Uploads only: the maximum number of bytes the client may upload
+	MaxSize int64
+}
+
+// Everything the client needs to use the URL
+type SignedURL struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+}
+
+// A URL that allows anyone with it to download prefix/filename
+func (s *Store) SignedDownloadURL(
+	prefix, filename string,
+	opts SignedURLOptions,
+) (*SignedURL, error) {
+	return s.signURL(http.MethodGet, prefix, filename, opts, nil)
+}
+
+// A URL that allows anyone with it to upload prefix/filename in a single PUT request
+func (s *Store) SignedUploadURL(
+	prefix, filename string,
+	opts SignedURLOptions,
+) (*SignedURL, error) {
+	return s.signURL(http.MethodPut, prefix, filename, opts, nil)
+}
+
+// A URL that allows anyone with it to start a resumable upload of prefix/filename.
+// The POST returns a session URI in the Location header, which the client uses
+// for the rest of the upload. Good for big files and flaky connections:
+// https://cloud.google.com/storage/docs/performing-resumable-uploads#xml-api
+func (s *Store) SignedResumableUploadURL(
+	prefix, filename string,
+	opts SignedURLOptions,
+) (*SignedURL, error) {
+	return s.signURL(http.MethodPost, prefix, filename, opts, map[string]string{
+		"x-goog-resumable": "start",
+	})
+}
+
+func (s *Store) signURL(
+	method string,
+	prefix, filename string,
+	opts SignedURLOptions,
+	headers map[string]string,
+) (*SignedURL, error) {
+	expires, err := opts.expiry()
+	if err != nil {
+		return nil, err
+	}
+
+	objectName, err := s.objectPath(prefix, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	isUpload := method != http.MethodGet
+	if isUpload && opts.ContentType != "" {
+		headers["Content-Type"] = opts.ContentType
+	}
+	if isUpload && opts.MaxSize > 0 {
+		// https://cloud.google.com/storage/docs/xml-api/reference-headers#xgoogcontentlengthrange
+		headers["x-goog-content-length-range"] = fmt.Sprintf("0,%d", opts.MaxSize)
+	}
+
+	url, err := s.getBucket().SignedURL(objectName, &storage.SignedURLOptions{
+		Scheme:         storage.SigningSchemeV4,
+		Method:         method,
+		Expires:        expires,
+		ContentType:    headers["Content-Type"],
+		Headers:        extensionHeaders(headers),
+		GoogleAccessID: s.Signing.GoogleAccessID,
+		PrivateKey:     s.Signing.PrivateKey,
+		SignBytes:      s.Signing.SignBytes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %s URL for %s: %w", method, objectName, err)
+	}
+
+	return &SignedURL{
+		URL:     url,
+		Method:  method,
+		Headers: headers,
+		Expires: expires,
+	}, nil
+}
+
+func (o SignedURLOptions) expiry() (time.Time, error) {
+	expires := o.Expires
+	if expires == 0 {
+		expires = DefaultSignedURLExpiry
+	}
+	if expires < 0 || expires > MaxSignedURLExpiry {
+		return time.Time{}, fmt.Errorf("signed URL expiry must be between 0 and %v, got %v", MaxSignedURLExpiry, expires)
+	}
+	return time.Now().Add(expires), nil
+}
+
+// The library wants the x-goog-* headers as "key:value".
+// The content type is signed separately
+func extensionHeaders(headers map[string]string) []string {
+	var result []string
+	for key, value := range headers {
+		if strings.EqualFold(key, "Content-Type") {
+			continue
+		}
+		result = append(result, key+":"+value)
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// A store that can sign URLs without talking to Google.
+// The key is throwaway, so GCS would never accept these URLs
+func newSigningStore(t testing.TB) *Store {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	opts := DefaultStoreOptions()
+	opts.Signing = SigningOptions{
+		GoogleAccessID: "signer@example.iam.gserviceaccount.com",
+		PrivateKey:     keyPEM,
+	}
+	return NewStoreWithOptions(client, "my-bucket", "base", opts)
+}
+
+func TestSignedURLs(t *testing.T) {
+	s := newSigningStore(t)
+
+	signedHeaders := func(t *testing.T, signed *SignedURL) string {
+		u, err := url.Parse(signed.URL)
+		if err != nil {
+			t.Fatalf("Failed to parse signed URL: %v", err)
+		}
+		if !strings.HasSuffix(u.Path, "/my-bucket/base/docs/report.pdf") {
+			t.Errorf("Expected the URL to point at the object under the base prefix, got %q", u.Path)
+		}
+		if u.Query().Get("X-Goog-Algorithm") != "GOOG4-RSA-SHA256" {
+			t.Errorf("Expected a V4 signature, got %q", u.Query().Get("X-Goog-Algorithm"))
+		}
+		return u.Query().Get("X-Goog-SignedHeaders")
+	}
+
+	t.Run("Download", func(t *testing.T) {
+		signed, err := s.SignedDownloadURL("docs", "report.pdf", SignedURLOptions{Expires: time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to sign URL: %v", err)
+		}
+		if signed.Method != http.MethodGet {
+			t.Errorf("Expected a GET, got %s", signed.Method)
+		}
+		if until := time.Until(signed.Expires); until <= 59*time.Minute || until > time.Hour {
+			t.Errorf("Expected the URL to expire in an hour, got %v", until)
+		}
+		signedHeaders(t, signed)
+	})
+
+	t.Run("Upload with constraints", func(t *testing.T) {
+		signed, err := s.SignedUploadURL("docs", "report.pdf", SignedURLOptions{
+			ContentType: "application/pdf",
+			MaxSize:     1024,
+		})
+		if err != nil {
+			t.Fatalf("Failed to sign URL: %v", err)
+		}
+		if signed.Method != http.MethodPut {
+			t.Errorf("Expected a PUT, got %s", signed.Method)
+		}
+
+		headers := signedHeaders(t, signed)
+		for _, header := range []string{"content-type", "x-goog-content-length-range"} {
+			if !strings.Contains(headers, header) {
+				t.Errorf("Expected %q to be signed, got %q", header, headers)
+			}
+		}
+		if signed.Headers["x-goog-content-length-range"] != "0,1024" {
+			t.Errorf("Expected the client to be told about the size limit, got %v", signed.Headers)
+		}
+		if signed.Headers["Content-Type"] != "application/pdf" {
+			t.Errorf("Expected the client to be told about the content type, got %v", signed.Headers)
+		}
+	})
+
+	t.Run("Resumable upload", func(t *testing.T) {
+		signed, err := s.SignedResumableUploadURL("docs", "report.pdf", SignedURLOptions{})
+		if err != nil {
+			t.Fatalf("Failed to sign URL: %v", err)
+		}
+		if signed.Method != http.MethodPost {
+			t.Errorf("Expected a POST, got %s", signed.Method)
+		}
+		if headers := signedHeaders(t, signed); !strings.Contains(headers, "x-goog-resumable") {
+			t.Errorf("Expected x-goog-resumable to be signed, got %q", headers)
+		}
+	})
+
+	t.Run("Expiry is validated", func(t *testing.T) {
+		if _, err := s.SignedDownloadURL("docs", "report.pdf", SignedURLOptions{Expires: 8 * 24 * time.Hour}); err == nil {
+			t.Errorf("Expected an expiry over 7 days to be rejected")
+		}
+	})
+}
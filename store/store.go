@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -34,10 +36,19 @@ import (
 // Interesting enough, they don't configure a timeout.. it just always retries on the following codes:
 // 408, 429, 500, 502, 503, 504 or connection errors sent by GCS
 // These codes above are called non-idempotent retries!
+// The backoff, attempts, policy and a timeout can be set with StoreOptions
 type Store struct {
-	Client     *storage.Client
-	BucketName string
-	BasePrefix string
+	Client           *storage.Client
+	BucketName       string
+	BasePrefix       string
+	TenantID         string
+	Quota            *QuotaManager
+	Audit            AuditSink
+	Events           *EventBus
+	Upload           UploadOptions
+	Retry            RetryOptions
+	OperationTimeout time.Duration
+	Signing          SigningOptions
 }
 
 // A function to pretty print bytes
@@ -62,14 +73,31 @@ func FormatBytes(bytes int64) string {
 // Creates a new Store Instance
 // The bucketName is where the files will be stored
 // It's optional to add a basPrefix. It's useful for tests
+// To isolate customers from each other, use ForTenant on the result
 func NewStore(
 	client *storage.Client,
 	bucketName, basePrefix string,
+) *Store {
+	return NewStoreWithOptions(client, bucketName, basePrefix, DefaultStoreOptions())
+}
+
+// Same as NewStore, but with control over uploads, retries and timeouts
+func NewStoreWithOptions(
+	client *storage.Client,
+	bucketName, basePrefix string,
+	opts StoreOptions,
 ) *Store {
 	return &Store{
-		Client:     client,
-		BucketName: bucketName,
-		BasePrefix: basePrefix,
+		Client:           client,
+		BucketName:       bucketName,
+		BasePrefix:       basePrefix,
+		Upload:           opts.Upload,
+		Retry:            opts.Retry,
+		OperationTimeout: opts.OperationTimeout,
+		Signing:          opts.Signing,
+		Quota:            opts.Quota,
+		Audit:            opts.Audit,
+		Events:           opts.Events,
 	}
 }
 
@@ -99,6 +127,7 @@ type ObjectInfo struct {
 	HumanReadableSize string    `json:"human_readable_size"`
 	Created           time.Time `json:"created"`
 	Updated           time.Time `json:"updated"`
+	Tags              []string  `json:"tags,omitempty"` // See SetTags
 }
 
 // Uploads a file go GCS
@@ -118,25 +147,93 @@ type ObjectInfo struct {
 //
 // Good reference to how the chunks and reties work:
 // https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_Writer
+// The chunk size and friends can be tuned with the Store's UploadOptions
+//
+// For GCS the upload is only committed when the Writer is closed, so that is
+// where most failures show up (precondition failures, the final chunk failing...)
+// We return the attributes of what actually landed: generation, size, checksums
+//
+// Pass WithProgress to get told how far the upload has got
 func (s *Store) UploadFile(
 	ctx context.Context,
 	reader io.Reader,
 	prefix, filename string,
+	opts ...TransferOption,
 ) (
-	written int64,
+	attrs *storage.ObjectAttrs,
 	err error,
 ) {
-	obj := s.GetObject(s.BasePrefix, prefix, filename)
+	objectPath, err := s.objectPath(prefix, filename)
+	defer func() { s.mutated(ctx, OperationUpload, "", objectPath, attrs, err) }()
+	if err != nil {
+		return nil, err
+	}
+	cfg := newTransferConfig(opts)
+	obj := s.getObject(objectPath)
 
-	writer := obj.NewWriter(ctx)
-	defer writer.Close()
+	// Cancelling the context is the way to abort an upload without committing it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// I set the size here in case we want to split it out
-	writer.ChunkSize = 16 * 1024 * 1024
+	size := cfg.sizeOf(reader)
+	quota, err := s.startQuotaWrite(ctx, objectPath, size)
+	if err != nil {
+		return nil, err
+	}
+	writer := s.newWriter(ctx, obj, size)
+
+	buf := s.Upload.getBuffer(copyBufferSize)
+	defer s.Upload.putBuffer(buf)
 
-	if written, err := io.Copy(writer, reader); err != nil {
+	tracked := cfg.track(quota.reader(reader), size)
+	if _, err := io.CopyBuffer(writer, tracked, buf); err != nil {
+		cancel()
+		writer.Close()
+		quota.abort()
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		quota.abort()
+		return nil, fmt.Errorf("failed to commit upload of %s: %w", obj.ObjectName(), err)
+	}
+
+	attrs = writer.Attrs()
+	quota.commit(attrs.Size)
+	tracked.finish()
+	return attrs, nil
+}
+
+// Downloads a file from GCS into the writer
+// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_ObjectHandle_NewReader
+// The reader knows the size of the object, so the progress always has a total
+func (s *Store) DownloadFile(
+	ctx context.Context,
+	writer io.Writer,
+	prefix, filename string,
+	opts ...TransferOption,
+) (
+	written int64,
+	err error,
+) {
+	objectPath, err := s.objectPath(prefix, filename)
+	if err != nil {
 		return 0, err
+	}
+	cfg := newTransferConfig(opts)
+	obj := s.getObject(objectPath)
+
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", obj.ObjectName(), err)
+	}
+	defer reader.Close()
+
+	tracked := cfg.track(reader, reader.Attrs.Size)
+	if written, err := io.Copy(writer, tracked); err != nil {
+		return written, err
 	} else {
+		tracked.finish()
 		return written, nil
 	}
 }
@@ -146,128 +243,57 @@ func (s *Store) UploadFile(
 func (s *Store) CreateDirectory(
 	ctx context.Context,
 	prefix, dirName string,
-) error {
-	fullPath := path.Join(s.BasePrefix, prefix, dirName)
-	if !strings.HasSuffix(fullPath, "/") {
-		fullPath += "/"
+) (err error) {
+	var attrs *storage.ObjectAttrs
+	objectPath, err := s.objectPath(prefix, dirName)
+	defer func() { s.mutated(ctx, OperationCreateDirectory, "", objectPath, attrs, err) }()
+	if err != nil {
+		return err
 	}
-	obj := s.getObject(fullPath)
+	obj := s.getObject(objectPath + "/")
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 
 	writer := obj.NewWriter(ctx)
-	return writer.Close()
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	attrs = writer.Attrs()
+	return nil
 }
 
+// Lists a single directory, a page at a time, in lexicographic order.
+// Pass lastObjectName as startAfter to get the next page. Every entry shows
+// up exactly once across the pages, see pagination.go for how.
+// Pass WithDirectoriesFirst to get the subdirectories before the files
 func (s *Store) ListPaginatedObjects(
 	ctx context.Context,
 	prefix, startAfter string,
 	limit int,
+	opts ...PageOption,
 ) (
 	objects []ObjectInfo,
 	lastObjectName string,
 	hasMore bool,
 	err error,
 ) {
-	fullPrefix := path.Join(s.BasePrefix, prefix)
-
-	// Add trailing slash to ensure we're listing within the directory
-	if fullPrefix != "" && !strings.HasSuffix(fullPrefix, "/") {
-		fullPrefix += "/"
+	// Comes with a trailing slash to ensure we're listing within the directory
+	fullPrefix, err := s.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
 	}
 
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#hdr-Listing_objects
 	// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_BucketHandle_Objects
 	// https://cloud.google.com/storage/docs/samples/storage-list-files
 	// Objects returns an iterator over the objects in the bucket that match the Query q.
 	// If q is nil, no filtering is done. Objects will be iterated over lexicographically by name.
 	// Note: The returned iterator is not safe for concurrent operations without explicit synchronization.
-	it := s.getBucket().Objects(ctx, &storage.Query{
-		Prefix:      fullPrefix,
-		Delimiter:   "/", // NB: without this, we can't list "directories"
-		StartOffset: startAfter,
-	})
-
-	count := 0
-
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, "", false, fmt.Errorf("error iterating objects: %v", err)
-		}
-
-		// Check if this is a directory prefix (returned by the delimiter)
-		if attrs.Prefix != "" {
-			// This is a directory
-			name := attrs.Prefix
-			if fullPrefix != "" && strings.HasPrefix(name, fullPrefix) {
-				name = strings.TrimPrefix(name, fullPrefix)
-			}
-			name = strings.TrimSuffix(name, "/")
-
-			if name != "" {
-				objInfo := ObjectInfo{
-					Name:              name,
-					IsDir:             true,
-					Size:              0,
-					HumanReadableSize: "",
-					Created:           time.Time{}, // Prefixes don't have timestamps
-					Updated:           time.Time{},
-				}
-				objects = append(objects, objInfo)
-				lastObjectName = attrs.Prefix
-				count++
-
-				// Check if we've reached the limit after processing
-				if count >= limit {
-					break
-				}
-			}
-			continue
-		}
-
-		// This is a regular file
-		// Remove the base prefix to get the relative name
-		name := attrs.Name
-		if fullPrefix != "" && strings.HasPrefix(name, fullPrefix) {
-			name = strings.TrimPrefix(name, fullPrefix)
-		}
-
-		// Skip empty names (like the directory we're listing itself)
-		if name == "" {
-			continue
-		}
-
-		objInfo := ObjectInfo{
-			Name:              name,
-			IsDir:             false,
-			Size:              attrs.Size,
-			HumanReadableSize: FormatBytes(attrs.Size),
-			Created:           attrs.Created,
-			Updated:           attrs.Updated,
-		}
-
-		objects = append(objects, objInfo)
-		lastObjectName = attrs.Name
-		count++
-
-		// Check if we've reached the limit after processing
-		if count >= limit {
-			break
-		}
-	}
-
-	// Check if there are more objects by trying to get the next one
-	hasMore = false
-	if count >= limit {
-		_, err := it.Next()
-		if err != iterator.Done {
-			hasMore = true
-		}
-	}
-
-	return objects, lastObjectName, hasMore, nil
+	return s.paginate(ctx, s.objectSource(), fullPrefix, startAfter, limit, nil, opts...)
 }
 
 // RenameObject renames an object within the bucket by copying it to the new location
@@ -282,14 +308,25 @@ func (s *Store) ListPaginatedObjects(
 // Coldline storage, or Archive storage can incur early deletion charges. If you move objects atomically,
 // no early deletion charges are incurred, regardless of the storage class of the objects being moved.
 // Since we don't use this, this shouldn't be a problem
+// The new object keeps every attribute of the old one, storage class included (see copyObject)
 func (s *Store) RenameObject(
 	ctx context.Context,
 	sourcePrefix, sourceObjectName string,
 	destinationPrefix, destinationObjectName string,
-) error {
+) (err error) {
+	var sourcePath, destinationPath string
+	var attrs *storage.ObjectAttrs
+	defer func() { s.mutated(ctx, OperationRename, sourcePath, destinationPath, attrs, err) }()
+
 	// Construct full paths
-	sourcePath := path.Join(s.BasePrefix, sourcePrefix, sourceObjectName)
-	destinationPath := path.Join(s.BasePrefix, destinationPrefix, destinationObjectName)
+	sourcePath, err = s.objectPath(sourcePrefix, sourceObjectName)
+	if err != nil {
+		return err
+	}
+	destinationPath, err = s.objectPath(destinationPrefix, destinationObjectName)
+	if err != nil {
+		return err
+	}
 
 	// Get source and destination object handles
 	srcObj := s.getObject(sourcePath)
@@ -301,15 +338,26 @@ func (s *Store) RenameObject(
 	// For a destination object that does not yet exist, set the DoesNotExist precondition.
 	dstObj = dstObj.If(storage.Conditions{DoesNotExist: true})
 
+	undoQuota, err := s.startQuotaMove(ctx, srcObj, destinationPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	// Copy the object to the new location
-	_, err := dstObj.CopierFrom(srcObj).Run(ctx)
+	srcAttrs, copied, err := s.copyObject(ctx, srcObj, dstObj)
 	if err != nil {
+		undoQuota()
 		return fmt.Errorf("failed to copy object from %s to %s: %v", sourcePath, destinationPath, err)
 	}
 
-	// Delete the original object
-	err = srcObj.Delete(ctx)
+	// Delete the original object, the generation we copied and nothing newer
+	err = srcObj.If(storage.Conditions{GenerationMatch: srcAttrs.Generation}).Delete(ctx)
 	if err != nil {
+		undoQuota()
+
 		// If deletion fails, we should try to clean up the copied object
 		// to avoid leaving duplicate files
 		if deleteErr := dstObj.Delete(ctx); deleteErr != nil {
@@ -318,12 +366,246 @@ func (s *Store) RenameObject(
 		return fmt.Errorf("failed to delete source object %s after copying: %v", sourcePath, err)
 	}
 
+	attrs = copied
 	return nil
 }
 
+// CopyObject copies an object to a new location and leaves the original where it is
+// Both paths are relative to the basePrefix, just like RenameObject.
+// The destination must not exist yet, we don't want to silently overwrite anything
+func (s *Store) CopyObject(
+	ctx context.Context,
+	sourcePrefix, sourceObjectName string,
+	destinationPrefix, destinationObjectName string,
+) (
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	var sourcePath, destinationPath string
+	defer func() { s.mutated(ctx, OperationCopy, sourcePath, destinationPath, attrs, err) }()
+
+	sourcePath, err = s.objectPath(sourcePrefix, sourceObjectName)
+	if err != nil {
+		return nil, err
+	}
+	destinationPath, err = s.objectPath(destinationPrefix, destinationObjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	srcObj := s.getObject(sourcePath)
+	dstObj := s.getObject(destinationPath).If(storage.Conditions{DoesNotExist: true})
+
+	quota, err := s.startQuotaCopy(ctx, srcObj, destinationPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, attrs, err = s.copyObject(ctx, srcObj, dstObj)
+	if err != nil {
+		quota.abort()
+		return nil, fmt.Errorf("failed to copy object from %s to %s: %v", sourcePath, destinationPath, err)
+	}
+	quota.commit(attrs.Size)
+	return attrs, nil
+}
+
+// Copies an object along with all of its attributes.
+// A plain copy keeps the content type, cache-control, custom metadata and so on,
+// but the storage class falls back to the bucket default, so a Coldline file
+// would quietly become Standard. We read them all and send them with the copy.
+// The source is pinned to the generation we read, so that is exactly what gets copied
+func (s *Store) copyObject(
+	ctx context.Context,
+	src, dst *storage.ObjectHandle,
+) (
+	srcAttrs, attrs *storage.ObjectAttrs,
+	err error,
+) {
+	srcAttrs, err = src.Attrs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copier := newCopier(dst, src.If(storage.Conditions{GenerationMatch: srcAttrs.Generation}), srcAttrs)
+	attrs, err = copier.Run(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAttrs, attrs, nil
+}
+
+// A copier that gives the destination everything copyableAttrs keeps, and
+// encrypts it with the same Cloud KMS key as the source (CMEK). Otherwise GCS
+// would use the default key of the bucket
+func newCopier(dst, src *storage.ObjectHandle, srcAttrs *storage.ObjectAttrs) *storage.Copier {
+	copier := dst.CopierFrom(src)
+	copier.ObjectAttrs = copyableAttrs(srcAttrs)
+	copier.DestinationKMSKeyName = kmsKeyName(srcAttrs.KMSKeyName)
+	return copier
+}
+
+// The attributes name the key version that encrypted the object, a copy
+// wants the key itself: ".../cryptoKeys/k/cryptoKeyVersions/1" -> ".../cryptoKeys/k"
+func kmsKeyName(keyVersion string) string {
+	key, _, _ := strings.Cut(keyVersion, "/cryptoKeyVersions/")
+	return key
+}
+
+// The attributes a copy can set on its destination.
+// Holds are left out on purpose, a copy shouldn't be locked because its source was
+func copyableAttrs(src *storage.ObjectAttrs) storage.ObjectAttrs {
+	return storage.ObjectAttrs{
+		ContentType:        src.ContentType,
+		ContentLanguage:    src.ContentLanguage,
+		ContentEncoding:    src.ContentEncoding,
+		ContentDisposition: src.ContentDisposition,
+		CacheControl:       src.CacheControl,
+		Metadata:           maps.Clone(src.Metadata),
+		StorageClass:       src.StorageClass,
+		CustomTime:         src.CustomTime,
+	}
+}
+
+// Deletes an object. With versioning enabled (see EnableVersioning) the data isn't
+// gone, the live version becomes noncurrent and can be brought back with RestoreObject
+// We delete the exact generation we looked at, which makes the request idempotent
+// (and so safe to retry) and means we never delete something that was just uploaded
+func (s *Store) DeleteObject(
+	ctx context.Context,
+	prefix, objectName string,
+) (err error) {
+	var attrs *storage.ObjectAttrs
+	objectPath, err := s.objectPath(prefix, objectName)
+	defer func() { s.mutated(ctx, OperationDelete, objectPath, "", attrs, err) }()
+	if err != nil {
+		return err
+	}
+	obj := s.getObject(objectPath)
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	attrs, err = obj.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", objectPath, err)
+	}
+
+	if err := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", objectPath, err)
+	}
+
+	s.quotaRelease(objectPath, attrs.Size)
+	return nil
+}
+
+// Lists every generation of an object, newest first.
+// The live version (if there is one) has a zero Deleted time
+// https://cloud.google.com/storage/docs/using-versioned-objects#list
+func (s *Store) ListObjectVersions(
+	ctx context.Context,
+	prefix, objectName string,
+) ([]*storage.ObjectAttrs, error) {
+	objectPath, err := s.objectPath(prefix, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// The prefix also matches longer names, so we filter on the exact name
+	var versions []*storage.ObjectAttrs
+	it := s.getBucket().Objects(ctx, &storage.Query{
+		Prefix:   objectPath,
+		Versions: true,
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error iterating versions of %s: %v", objectPath, err)
+		}
+		if attrs.Name == objectPath {
+			versions = append(versions, attrs)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Generation > versions[j].Generation
+	})
+	return versions, nil
+}
+
+// Brings back an older generation of an object by copying it over the live version
+// Needs versioning to be enabled, otherwise there is nothing to restore
+// https://cloud.google.com/storage/docs/using-versioned-objects#restore
+func (s *Store) RestoreObject(
+	ctx context.Context,
+	prefix, objectName string,
+	generation int64,
+) (
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	objectPath, err := s.objectPath(prefix, objectName)
+	// The source is written the way gsutil does, object#generation
+	defer func() {
+		s.mutated(ctx, OperationRestore, fmt.Sprintf("%s#%d", objectPath, generation), objectPath, attrs, err)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	srcObj := s.getObject(objectPath).Generation(generation)
+	dstObj := s.getObject(objectPath)
+
+	quota, err := s.startQuotaCopy(ctx, srcObj, objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// Like a copy, the restored version keeps its storage class, metadata and key
+	_, attrs, err = s.copyObject(ctx, srcObj, dstObj)
+	if err != nil {
+		quota.abort()
+		return nil, fmt.Errorf("failed to restore generation %d of %s: %v", generation, objectPath, err)
+	}
+	quota.commit(attrs.Size)
+	return attrs, nil
+}
+
+// Called once a method that changes the bucket is done (usually in a defer).
+// It gets recorded in the audit log and, if it worked, published as an event
+func (s *Store) mutated(
+	ctx context.Context,
+	operation Operation,
+	source, destination string,
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	s.audit(ctx, operation, source, destination, attrs, err)
+	if err == nil {
+		s.publish(ctx, operation, source, destination, attrs)
+	}
+}
+
 // Gets a bucket handle (private since it's intended to be a helper function)
+// Object handles inherit the retry configuration from the bucket handle
 func (s *Store) getBucket() *storage.BucketHandle {
-	return s.Client.Bucket(s.BucketName)
+	bkt := s.Client.Bucket(s.BucketName)
+	if opts := s.Retry.retryOptions(); len(opts) > 0 {
+		bkt = bkt.Retryer(opts...)
+	}
+	return bkt
 }
 
 // Using an objectPath, you can get an object
@@ -333,6 +615,8 @@ func (s *Store) getObject(objectPath string) *storage.ObjectHandle {
 }
 
 // The BEST way to handle paths
+// CAREFUL: the parts are joined as is, without the BasePrefix or any validation.
+// User input should go through CleanPath first
 func (s *Store) GetObject(parts ...string) *storage.ObjectHandle {
 	fullPath := path.Join(parts...)
 	return s.getObject(fullPath)
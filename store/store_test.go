@@ -2,9 +2,16 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
 )
 
 // =============== // MAIN SETUP // ===============
@@ -71,13 +78,24 @@ func TestCRUD(t *testing.T) {
 		// file, header, err := r.FormFile("uploadfile")
 		// Where file is a io.Reader
 		uploadedFileBytes := []byte(fileContents)
-		written, err := s.UploadFile(h.Context, bytes.NewReader(uploadedFileBytes), "", fileName)
+		attrs, err := s.UploadFile(h.Context, bytes.NewReader(uploadedFileBytes), "", fileName)
 
 		// Make sure we get no error
 		if err != nil {
 			t.Fatalf("Failed to upload file: %v", err)
 		}
-		t.Logf("Uploaded %s", FormatBytes(written))
+		t.Logf("Uploaded %s (generation %d)", FormatBytes(attrs.Size), attrs.Generation)
+
+		// Make sure we get the attributes of what actually landed
+		if attrs.Size != int64(len(fileContents)) {
+			t.Errorf("Expected a size of %d, got %d", len(fileContents), attrs.Size)
+		}
+		if attrs.Generation == 0 {
+			t.Errorf("Expected the generation to be set")
+		}
+		if len(attrs.MD5) == 0 || attrs.CRC32C == 0 {
+			t.Errorf("Expected the checksums to be set")
+		}
 
 		// Verify file is there
 		if !h.VerifyFile(path.Join(h.TestPrefix, fileName)) {
@@ -90,6 +108,33 @@ func TestCRUD(t *testing.T) {
 		}
 	})
 
+	t.Run("Failed upload is reported", func(t *testing.T) {
+		// The upload is only committed on Close, so a cancelled
+		// context has to show up as an error and leave nothing behind
+		ctx, cancel := context.WithCancel(h.Context)
+		cancel()
+
+		if _, err := s.UploadFile(ctx, bytes.NewReader([]byte(fileContents)), "", "cancelled.txt"); err == nil {
+			t.Fatalf("Expected the cancelled upload to fail")
+		}
+
+		if h.VerifyFile(path.Join(h.TestPrefix, "cancelled.txt")) {
+			t.Fatalf("Cancelled upload should not have been committed")
+		}
+	})
+
+	t.Run("Path traversal is rejected", func(t *testing.T) {
+		_, err := s.UploadFile(h.Context, bytes.NewReader([]byte(fileContents)), "..", "escaped.txt")
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("Expected an invalid path error, got %v", err)
+		}
+
+		err = s.RenameObject(h.Context, "", fileName, "../..", fileName)
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("Expected an invalid path error, got %v", err)
+		}
+	})
+
 	t.Run("Create Directory", func(t *testing.T) {
 		err := s.CreateDirectory(h.Context, "", dirName)
 
@@ -138,6 +183,82 @@ func TestCRUD(t *testing.T) {
 		}
 	})
 
+	t.Run("List objects with options", func(t *testing.T) {
+		objects, _, hasMore, err := s.ListObjects(h.Context, "", ListOptions{Extensions: []string{"txt"}})
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 1 || objects[0].Name != fileName || hasMore {
+			t.Fatalf("Expected only %q, got %+v", fileName, objects)
+		}
+
+		// The directory has no size, so it comes last
+		objects, cursor, hasMore, err := s.ListObjects(h.Context, "", ListOptions{SortBy: SortBySize, Descending: true, Limit: 1})
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 1 || objects[0].Name != fileName || !hasMore {
+			t.Fatalf("Expected %q first, got %+v", fileName, objects)
+		}
+
+		objects, _, hasMore, err = s.ListObjects(h.Context, "", ListOptions{SortBy: SortBySize, Descending: true, Limit: 1, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 1 || objects[0].Name != dirName || hasMore {
+			t.Fatalf("Expected %q on the second page, got %+v", dirName, objects)
+		}
+
+		// Descending puts "testUpload.txt" before "testDir", unless directories go first
+		objects, _, _, err = s.ListObjects(h.Context, "", ListOptions{DirectoriesFirst: true, Descending: true})
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 2 || objects[0].Name != dirName {
+			t.Fatalf("Expected %q first, got %+v", dirName, objects)
+		}
+	})
+
+	t.Run("Search objects", func(t *testing.T) {
+		objects, _, hasMore, err := s.SearchObjects(h.Context, "", "UPLOAD", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Failed to search objects: %v", err)
+		}
+		if len(objects) != 1 || objects[0].Name != fileName || hasMore {
+			t.Fatalf("Expected only %q, got %+v", fileName, objects)
+		}
+
+		objects, _, _, err = s.SearchObjects(h.Context, "", "test*", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Failed to search objects: %v", err)
+		}
+		if names := listNames(objects); !slices.Equal(names, []string{dirName + "/", fileName}) {
+			t.Fatalf("Expected the directory and the file, got %q", names)
+		}
+	})
+
+	t.Run("Download File", func(t *testing.T) {
+		var reports []Progress
+		var buf bytes.Buffer
+		written, err := s.DownloadFile(h.Context, &buf, "", fileName, WithProgress(func(p Progress) {
+			reports = append(reports, p)
+		}))
+		if err != nil {
+			t.Fatalf("Failed to download file: %v", err)
+		}
+
+		if written != int64(len(fileContents)) || buf.String() != fileContents {
+			t.Fatalf("Downloaded file contents do not match")
+		}
+
+		if len(reports) == 0 || !reports[len(reports)-1].Done {
+			t.Fatalf("Expected a final progress report")
+		}
+		if total := reports[len(reports)-1].TotalBytes; total != written {
+			t.Errorf("Expected a total of %d bytes, got %d", written, total)
+		}
+	})
+
 	t.Run("List objects with pagination requiring two calls", func(t *testing.T) {
 		// Create an additional file to ensure we have enough objects for pagination
 		_, err := s.UploadFile(h.Context, bytes.NewReader([]byte(file2Contents)), "", fileName2)
@@ -193,6 +314,28 @@ func TestCRUD(t *testing.T) {
 
 	// =============== // UPDATE // ===============
 
+	t.Run("Tag File", func(t *testing.T) {
+		if _, err := s.SetTags(h.Context, "", fileName2, []string{"Urgent", "invoice"}); err != nil {
+			t.Fatalf("Failed to set tags: %v", err)
+		}
+
+		tags, err := s.GetTags(h.Context, "", fileName2)
+		if err != nil {
+			t.Fatalf("Failed to get tags: %v", err)
+		}
+		if !slices.Equal(tags, []string{"invoice", "urgent"}) {
+			t.Errorf("Expected the tags [invoice urgent], got %q", tags)
+		}
+
+		objects, _, _, err := s.ListByTag(h.Context, "", "urgent", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Failed to list by tag: %v", err)
+		}
+		if names := listNames(objects); !slices.Equal(names, []string{fileName2}) {
+			t.Errorf("Expected only %q to be tagged, got %q", fileName2, names)
+		}
+	})
+
 	t.Run("Rename File", func(t *testing.T) {
 		// Rename the original file
 		err := s.RenameObject(h.Context, "", fileName2, "", renamedFile2)
@@ -214,7 +357,173 @@ func TestCRUD(t *testing.T) {
 		if !h.VerifyFileContents(path.Join(h.TestPrefix, renamedFile2), file2Contents) {
 			t.Fatalf("Renamed file contents do not match original")
 		}
+
+		// The tags move with it
+		tags, err := s.GetTags(h.Context, "", renamedFile2)
+		if err != nil {
+			t.Fatalf("Failed to get tags: %v", err)
+		}
+		if !slices.Equal(tags, []string{"invoice", "urgent"}) {
+			t.Errorf("Expected the renamed file to keep its tags, got %q", tags)
+		}
 	})
 
 	// =============== // DELETE (VERSION CONTROL) // ===============
+
+	h.EnableVersioning()
+
+	t.Run("Delete File", func(t *testing.T) {
+		if err := s.DeleteObject(h.Context, "", renamedFile2); err != nil {
+			t.Fatalf("Failed to delete file: %v", err)
+		}
+
+		if h.VerifyFile(path.Join(h.TestPrefix, renamedFile2)) {
+			t.Fatalf("Deleted file %q should not exist", renamedFile2)
+		}
+	})
+
+	t.Run("Restore File", func(t *testing.T) {
+		versions, err := s.ListObjectVersions(h.Context, "", renamedFile2)
+		if err != nil {
+			t.Fatalf("Failed to list versions: %v", err)
+		}
+		if len(versions) == 0 {
+			t.Fatalf("Expected the deleted file to have a noncurrent version")
+		}
+		if versions[0].Deleted.IsZero() {
+			t.Fatalf("Expected the newest version to be noncurrent")
+		}
+
+		attrs, err := s.RestoreObject(h.Context, "", renamedFile2, versions[0].Generation)
+		if err != nil {
+			t.Fatalf("Failed to restore file: %v", err)
+		}
+		if attrs.Generation == versions[0].Generation {
+			t.Errorf("Expected the restored file to be a new generation")
+		}
+
+		if !h.VerifyFileContents(path.Join(h.TestPrefix, renamedFile2), file2Contents) {
+			t.Fatalf("Restored file contents do not match original")
+		}
+	})
+}
+
+// =============== // ATTRIBUTES // ===============
+
+// The attributes a user can set on an object, which must survive a copy
+func differentAttributes(a, b *storage.ObjectAttrs) []string {
+	var different []string
+	compare := func(name string, equal bool) {
+		if !equal {
+			different = append(different, name)
+		}
+	}
+	compare("ContentType", a.ContentType == b.ContentType)
+	compare("ContentLanguage", a.ContentLanguage == b.ContentLanguage)
+	compare("ContentEncoding", a.ContentEncoding == b.ContentEncoding)
+	compare("ContentDisposition", a.ContentDisposition == b.ContentDisposition)
+	compare("CacheControl", a.CacheControl == b.CacheControl)
+	compare("Metadata", maps.Equal(a.Metadata, b.Metadata))
+	compare("StorageClass", a.StorageClass == b.StorageClass)
+	compare("CustomTime", a.CustomTime.Equal(b.CustomTime))
+	return different
+}
+
+func TestCopyableAttrs(t *testing.T) {
+	src := &storage.ObjectAttrs{
+		Name:               "base/report.csv",
+		Generation:         42,
+		Size:               1024,
+		ContentType:        "text/csv",
+		ContentLanguage:    "fr",
+		ContentEncoding:    "gzip",
+		ContentDisposition: `attachment; filename="report.csv"`,
+		CacheControl:       "private, max-age=60",
+		Metadata:           map[string]string{"tags": "invoice", "owner": "ada"},
+		StorageClass:       "COLDLINE",
+		CustomTime:         time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+		TemporaryHold:      true,
+	}
+
+	copied := copyableAttrs(src)
+	if different := differentAttributes(src, &copied); len(different) > 0 {
+		t.Errorf("Expected every attribute to be copied, these weren't: %v", different)
+	}
+	if copied.Name != "" || copied.Generation != 0 || copied.TemporaryHold {
+		t.Errorf("Expected only the attributes a copy can set, got %+v", copied)
+	}
+
+	// The copy gets its own map
+	copied.Metadata["tags"] = "changed"
+	if src.Metadata["tags"] != "invoice" {
+		t.Errorf("Changing the copy changed the source metadata")
+	}
+}
+
+func TestKMSKeyName(t *testing.T) {
+	const key = "projects/p/locations/eu/keyRings/files/cryptoKeys/objects"
+	tests := []struct {
+		keyVersion string
+		expected   string
+	}{
+		{"", ""},
+		{key, key},
+		{key + "/cryptoKeyVersions/3", key},
+	}
+
+	for _, test := range tests {
+		if result := kmsKeyName(test.keyVersion); result != test.expected {
+			t.Errorf("kmsKeyName(%q): expected %q, got %q", test.keyVersion, test.expected, result)
+		}
+	}
+}
+
+func TestRenameKeepsAttributes(t *testing.T) {
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+
+	// Left in the default storage class: a colder one would be charged its
+	// minimum storage duration on every run. TestCopyableAttrs covers the class
+	w := h.Client.Bucket(h.BucketName).Object(path.Join(h.TestPrefix, "report.csv")).NewWriter(h.Context)
+	w.ContentType = "text/csv"
+	w.ContentLanguage = "fr"
+	w.ContentDisposition = `attachment; filename="report.csv"`
+	w.CacheControl = "private, max-age=60"
+	w.Metadata = map[string]string{"tags": "invoice", "owner": "ada"}
+	w.CustomTime = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := w.Write([]byte("a,b\n1,2\n")); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	before := w.Attrs()
+
+	attrsOf := func(objectName string) *storage.ObjectAttrs {
+		t.Helper()
+		attrs, err := h.Client.Bucket(h.BucketName).Object(path.Join(h.TestPrefix, objectName)).Attrs(h.Context)
+		if err != nil {
+			t.Fatalf("Failed to get the attributes of %q: %v", objectName, err)
+		}
+		return attrs
+	}
+
+	t.Run("Rename", func(t *testing.T) {
+		if err := s.RenameObject(h.Context, "", "report.csv", "archive", "report.csv"); err != nil {
+			t.Fatalf("Failed to rename file: %v", err)
+		}
+		if different := differentAttributes(before, attrsOf("archive/report.csv")); len(different) > 0 {
+			t.Errorf("The rename lost %v", different)
+		}
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		attrs, err := s.CopyObject(h.Context, "archive", "report.csv", "", "copy.csv")
+		if err != nil {
+			t.Fatalf("Failed to copy file: %v", err)
+		}
+		if different := differentAttributes(before, attrs); len(different) > 0 {
+			t.Errorf("The copy lost %v", different)
+		}
+	})
 }
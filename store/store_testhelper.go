@@ -4,14 +4,11 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
 	"strings"
 	"testing"
-	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/oklog/ulid/v2"
 )
 
 type TestHelper struct {
@@ -22,14 +19,6 @@ type TestHelper struct {
 	t          testing.TB
 }
 
-func newDefaultULID() string {
-	source := rand.NewSource(time.Now().UnixNano())
-	entropy := rand.New(source)
-
-	ulid := ulid.MustNew(ulid.Timestamp(time.Now()), entropy)
-	return strings.ToLower(ulid.String())
-}
-
 func NewTestHelper(t testing.TB) *TestHelper {
 	ctx := context.Background()
 
@@ -84,6 +73,28 @@ func NewTestHelper(t testing.TB) *TestHelper {
 	return helper
 }
 
+// Turns on versioning for the test, and puts the bucket back the way it was
+// afterwards. The bucket is shared, other tests shouldn't see the change
+func (h *TestHelper) EnableVersioning() {
+	bkt := h.Client.Bucket(h.BucketName)
+	attrs, err := bkt.Attrs(h.Context)
+	if err != nil {
+		h.t.Fatalf("Failed to get the bucket attributes: %v", err)
+	}
+	if attrs.VersioningEnabled {
+		return
+	}
+
+	if err := EnableVersioning(h.Context, h.Client, h.BucketName); err != nil {
+		h.t.Fatalf("Failed to enable versioning: %v", err)
+	}
+	h.t.Cleanup(func() {
+		if _, err := bkt.Update(h.Context, storage.BucketAttrsToUpdate{VersioningEnabled: false}); err != nil {
+			h.t.Errorf("Failed to turn versioning back off: %v", err)
+		}
+	})
+}
+
 func (h *TestHelper) Cleanup() {
 	// TODO - Add code that cleans the bucket by removing files
 }
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// TAGS
+// ===================================
+//
+// Users tag files ("invoice", "2026", "urgent") to find them later.
+// The tags live on the object itself, in the custom metadata:
+// https://cloud.google.com/storage/docs/metadata#custom-metadata
+//
+// So they need no database, and they move with the object: a copy (and so
+// a rename) keeps the metadata of the source.
+//
+// GCS can't filter a listing by metadata though, so ListByTag has to look at
+// everything below the prefix, just like SearchObjects, with the same paging.
+
+// The custom metadata key, the value is the tags separated by commas
+const tagsMetadataKey = "tags"
+
+// Custom metadata is limited to 8 KiB per object, we leave plenty for others
+const (
+	MaxTags      = 32
+	MaxTagLength = 64
+)
+
+var ErrInvalidTag = errors.New("invalid tag")
+
+// Letters, digits and a bit of punctuation. Never a comma, it separates them
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}._-]*$`)
+
+// Replaces the tags of a file. No tags removes them all.
+// Tags are case-insensitive, they're stored lowercase, sorted and without duplicates
+func (s *Store) SetTags(
+	ctx context.Context,
+	prefix, objectName string,
+	tags []string,
+) (
+	attrs *storage.ObjectAttrs,
+	err error,
+) {
+	objectPath, err := s.objectPath(prefix, objectName)
+	defer func() { s.mutated(ctx, OperationSetTags, "", objectPath, attrs, err) }()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err = normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// Only our key changes, the rest of the metadata is left alone.
+	// An empty value is as good as no tags, the client can't remove a single key
+	attrs, err = s.getObject(objectPath).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: map[string]string{tagsMetadataKey: strings.Join(tags, ",")},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set the tags of %s: %w", objectPath, err)
+	}
+	return attrs, nil
+}
+
+func (s *Store) GetTags(ctx context.Context, prefix, objectName string) ([]string, error) {
+	objectPath, err := s.objectPath(prefix, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	attrs, err := s.getObject(objectPath).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the tags of %s: %w", objectPath, err)
+	}
+	return tagsFromMetadata(attrs.Metadata), nil
+}
+
+// Finds everything below prefix with the tag, a page at a time.
+// The names are relative to prefix, see SearchObjects for the paging and the cap
+func (s *Store) ListByTag(
+	ctx context.Context,
+	prefix, tag string,
+	opts SearchOptions,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	fullPrefix, err := s.directoryPath(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return s.listByTag(ctx, s.objectSource(), fullPrefix, tag, opts, nil)
+}
+
+// keep filters the matches, nil keeps everything
+func (s *Store) listByTag(
+	ctx context.Context,
+	src objectSource,
+	fullPrefix, tag string,
+	opts SearchOptions,
+	keep func(ObjectInfo) bool,
+) (
+	objects []ObjectInfo,
+	nextCursor string,
+	hasMore bool,
+	err error,
+) {
+	tags, err := normalizeTags([]string{tag})
+	if err != nil {
+		return nil, "", false, err
+	}
+	return s.scan(ctx, src, fullPrefix, opts, func(entry ObjectInfo) bool {
+		return slices.Contains(entry.Tags, tags[0]) && (keep == nil || keep(entry))
+	})
+}
+
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) > MaxTagLength || !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+		}
+		normalized = append(normalized, tag)
+	}
+
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > MaxTags {
+		return nil, fmt.Errorf("%w: at most %d tags, got %d", ErrInvalidTag, MaxTags, len(normalized))
+	}
+	return normalized, nil
+}
+
+func tagsFromMetadata(metadata map[string]string) []string {
+	var tags []string
+	for tag := range strings.SplitSeq(metadata[tagsMetadataKey], ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
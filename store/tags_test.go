@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tooMany := make([]string, MaxTags+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("tag-%d", i)
+	}
+
+	tests := []struct {
+		tags     []string
+		expected []string
+		valid    bool
+	}{
+		{nil, []string{}, true},
+		{[]string{"Urgent", " invoice ", "2026"}, []string{"2026", "invoice", "urgent"}, true},
+		{[]string{"urgent", "URGENT", "Urgent"}, []string{"urgent"}, true},
+		{[]string{"q1.report", "to_do", "work-in-progress", "café"}, []string{"café", "q1.report", "to_do", "work-in-progress"}, true},
+		{[]string{strings.Repeat("x", MaxTagLength)}, []string{strings.Repeat("x", MaxTagLength)}, true},
+		{[]string{strings.Repeat("x", MaxTagLength+1)}, nil, false},
+		{[]string{""}, nil, false},
+		{[]string{"a,b"}, nil, false},
+		{[]string{"two words"}, nil, false},
+		{[]string{"-draft"}, nil, false},
+		{[]string{"ok", "not/ok"}, nil, false},
+		{append(tooMany[:MaxTags:MaxTags], "tag-0"), nil, true}, // Duplicates don't count
+		{tooMany, nil, false},
+	}
+
+	for i, test := range tests {
+		tags, err := normalizeTags(test.tags)
+		if !test.valid {
+			if !errors.Is(err, ErrInvalidTag) {
+				t.Errorf("normalizeTags(%d): expected an invalid tag, got %q (%v)", i, tags, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeTags(%d): unexpected error: %v", i, err)
+			continue
+		}
+		if test.expected != nil && !slices.Equal(tags, test.expected) {
+			t.Errorf("normalizeTags(%d): expected %q, got %q", i, test.expected, tags)
+		}
+	}
+}
+
+func TestTagsFromMetadata(t *testing.T) {
+	tests := []struct {
+		metadata map[string]string
+		expected []string
+	}{
+		{nil, nil},
+		{map[string]string{"other": "value"}, nil},
+		{map[string]string{tagsMetadataKey: ""}, nil},
+		{map[string]string{tagsMetadataKey: "invoice"}, []string{"invoice"}},
+		{map[string]string{tagsMetadataKey: "2026,invoice,urgent"}, []string{"2026", "invoice", "urgent"}},
+	}
+
+	for i, test := range tests {
+		if tags := tagsFromMetadata(test.metadata); !slices.Equal(tags, test.expected) {
+			t.Errorf("tagsFromMetadata(%d): expected %q, got %q", i, test.expected, tags)
+		}
+	}
+}
+
+func TestListByTag(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+	tagged := func(tags string) map[string]string {
+		return map[string]string{tagsMetadataKey: tags}
+	}
+	src := fakeSource{
+		names: []string{
+			"base/",
+			"base/2025/",
+			"base/2025/march.pdf",
+			"base/2026/invoice-1.pdf",
+			"base/2026/invoice-2.pdf",
+			"base/notes.txt",
+			"base/" + compositeTempDir + "/part-1",
+		},
+		metadata: map[string]map[string]string{
+			"base/2025/":                           tagged("invoice"),
+			"base/2025/march.pdf":                  tagged("invoice,paid"),
+			"base/2026/invoice-1.pdf":              tagged("2026,invoice,urgent"),
+			"base/2026/invoice-2.pdf":              tagged("2026"),
+			"base/notes.txt":                       {"other": "invoice"},
+			"base/" + compositeTempDir + "/part-1": tagged("invoice"),
+		},
+	}
+	listByTag := func(prefix, tag string, keep func(ObjectInfo) bool) []string {
+		t.Helper()
+		objects, _, hasMore, err := s.listByTag(context.Background(), src, prefix, tag, SearchOptions{}, keep)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tag, err)
+		}
+		if hasMore {
+			t.Errorf("%q: expected a single page", tag)
+		}
+		return listNames(objects)
+	}
+
+	tests := []struct {
+		prefix   string
+		tag      string
+		expected []string
+	}{
+		{"base/", "invoice", []string{"2025/", "2025/march.pdf", "2026/invoice-1.pdf"}},
+		{"base/", " Invoice ", []string{"2025/", "2025/march.pdf", "2026/invoice-1.pdf"}},
+		{"base/", "2026", []string{"2026/invoice-1.pdf", "2026/invoice-2.pdf"}},
+		{"base/2025/", "paid", []string{"march.pdf"}},
+		{"base/", "invoic", nil},
+		{"base/", "other", nil},
+	}
+
+	for _, test := range tests {
+		if names := listByTag(test.prefix, test.tag, nil); !slices.Equal(names, test.expected) {
+			t.Errorf("%q in %q: expected %q, got %q", test.tag, test.prefix, test.expected, names)
+		}
+	}
+
+	t.Run("Filtered", func(t *testing.T) {
+		files := func(entry ObjectInfo) bool { return !entry.IsDir }
+		expected := []string{"2025/march.pdf", "2026/invoice-1.pdf"}
+		if names := listByTag("base/", "invoice", files); !slices.Equal(names, expected) {
+			t.Errorf("Expected %q, got %q", expected, names)
+		}
+	})
+
+	t.Run("Invalid tag", func(t *testing.T) {
+		if _, _, _, err := s.listByTag(context.Background(), src, "base/", "a,b", SearchOptions{}, nil); !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("Expected an invalid tag, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ===================================
+// TENANTS
+// ===================================
+//
+// We isolate customers by giving each of them their own directory:
+// <BasePrefix>/tenant/<id>/
+// A tenant store is just a Store with the BasePrefix pointing at that directory.
+// Since every operation resolves its paths through objectPath and directoryPath,
+// nothing can be listed, renamed or copied outside of it (see paths.go).
+// A tenant store shares the client and every other setting with its parent.
+
+// The directory under the BasePrefix that holds the tenants
+const tenantsDir = "tenant"
+
+var ErrInvalidTenant = errors.New("invalid tenant id")
+
+// Tenant ids end up in object names, so we keep them boring
+var tenantIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,62}$`)
+
+// Returns a Store whose every operation is confined to tenant/<id>/
+func (s *Store) ForTenant(id string) (*Store, error) {
+	if !tenantIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTenant, id)
+	}
+
+	scoped := *s
+	scoped.BasePrefix = path.Join(s.BasePrefix, tenantsDir, id)
+	scoped.TenantID = id
+	return &scoped, nil
+}
+
+// Works out which tenant an object belongs to from its full name,
+// e.g. "base/tenant/acme/plans.pdf" -> "acme". Empty when it's outside the tenants
+func tenantOf(basePrefix, objectName string) string {
+	rest, ok := strings.CutPrefix(objectName, path.Join(basePrefix, tenantsDir)+"/")
+	if !ok {
+		return ""
+	}
+	id, _, ok := strings.Cut(rest, "/")
+	if !ok || !tenantIDPattern.MatchString(id) {
+		return ""
+	}
+	return id
+}
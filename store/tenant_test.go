@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestForTenant(t *testing.T) {
+	s := NewStore(nil, "bucket", "base")
+
+	t.Run("Scopes the base prefix", func(t *testing.T) {
+		tenant, err := s.ForTenant("acme-42")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if tenant.BasePrefix != "base/tenant/acme-42" {
+			t.Errorf("Expected the base prefix %q, got %q", "base/tenant/acme-42", tenant.BasePrefix)
+		}
+		if tenant.TenantID != "acme-42" {
+			t.Errorf("Expected the tenant id to be set, got %q", tenant.TenantID)
+		}
+		if s.BasePrefix != "base" {
+			t.Errorf("The parent store should not change, got %q", s.BasePrefix)
+		}
+	})
+
+	t.Run("Invalid ids", func(t *testing.T) {
+		for _, id := range []string{"", "..", "a/b", "../other", "-leading", "with space", "a\x00"} {
+			if _, err := s.ForTenant(id); !errors.Is(err, ErrInvalidTenant) {
+				t.Errorf("ForTenant(%q): expected an invalid tenant error, got %v", id, err)
+			}
+		}
+	})
+
+	t.Run("Can't reach other tenants", func(t *testing.T) {
+		tenant, _ := s.ForTenant("acme")
+		for _, parts := range [][]string{
+			{"..", "other/secret.txt"},
+			{"../other", "secret.txt"},
+			{"", "../../../secret.txt"},
+		} {
+			if _, err := tenant.objectPath(parts...); !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("objectPath(%q): expected an invalid path, got %v", parts, err)
+			}
+		}
+		if _, err := tenant.directoryPath(".."); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected listing the parent to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestTenantIsolation(t *testing.T) {
+	h := NewTestHelper(t)
+	s := NewStore(h.Client, h.BucketName, h.TestPrefix)
+
+	acme, _ := s.ForTenant("acme")
+	globex, _ := s.ForTenant("globex")
+
+	const contents = "acme's secret plans"
+	if _, err := acme.UploadFile(h.Context, bytes.NewReader([]byte(contents)), "plans", "secret.txt"); err != nil {
+		t.Fatalf("Failed to upload file: %v", err)
+	}
+
+	t.Run("File lands in the tenant directory", func(t *testing.T) {
+		if !h.VerifyFileContents(path.Join(h.TestPrefix, "tenant/acme/plans/secret.txt"), contents) {
+			t.Fatalf("Expected the file under the tenant directory")
+		}
+	})
+
+	t.Run("Other tenants can't list it", func(t *testing.T) {
+		objects, _, _, err := globex.ListPaginatedObjects(h.Context, "", "", 10)
+		if err != nil {
+			t.Fatalf("Failed to list objects: %v", err)
+		}
+		if len(objects) != 0 {
+			t.Errorf("Expected globex to see nothing, got %d objects", len(objects))
+		}
+	})
+
+	t.Run("Other tenants can't copy it", func(t *testing.T) {
+		_, err := globex.CopyObject(h.Context, "../acme/plans", "secret.txt", "", "stolen.txt")
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("Expected an invalid path error, got %v", err)
+		}
+	})
+
+	t.Run("Tenant can copy within its own directory", func(t *testing.T) {
+		attrs, err := acme.CopyObject(h.Context, "plans", "secret.txt", "backup", "secret.txt")
+		if err != nil {
+			t.Fatalf("Failed to copy file: %v", err)
+		}
+		if attrs.Name != path.Join(h.TestPrefix, "tenant/acme/backup/secret.txt") {
+			t.Errorf("Expected the copy under the tenant directory, got %q", attrs.Name)
+		}
+		if !h.VerifyFile(path.Join(h.TestPrefix, "tenant/acme/plans/secret.txt")) {
+			t.Errorf("Expected the original to still be there")
+		}
+	})
+}
+
+func TestTenantOf(t *testing.T) {
+	tests := []struct {
+		basePrefix string
+		objectName string
+		expected   string
+	}{
+		{"base", "base/tenant/acme/plans.pdf", "acme"},
+		{"base", "base/tenant/acme/", "acme"},
+		{"", "tenant/acme/a/b/c.txt", "acme"},
+		{"base", "base/tenant/acme", ""},
+		{"base", "base/shared/plans.pdf", ""},
+		{"base", "other/tenant/acme/plans.pdf", ""},
+		{"base", "base/tenant/-bad/plans.pdf", ""},
+	}
+
+	for _, test := range tests {
+		result := tenantOf(test.basePrefix, test.objectName)
+		if result != test.expected {
+			t.Errorf("tenantOf(%q, %q): expected %q, got %q", test.basePrefix, test.objectName, test.expected, result)
+		}
+	}
+}
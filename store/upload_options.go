@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ===================================
+// UPLOAD TUNING
+// ===================================
+//
+// Every Writer allocates a buffer of Writer.ChunkSize (16 MiB by default)
+// So 100 concurrent uploads means 1.6 GB of buffers, even if the files are tiny.
+// These options allow memory-constrained services to turn that down.
+// https://cloud.google.com/go/docs/reference/cloud.google.com/go/storage/latest#cloud_google_com_go_storage_Writer
+
+// The Writer rounds the ChunkSize up to a multiple of this
+const chunkSizeMultiple = 256 * 1024
+
+// The size of the buffer used to copy the reader into the Writer
+const copyBufferSize = 32 * 1024
+
+// Same as the library default
+const defaultChunkSize = 16 * 1024 * 1024
+
+type UploadOptions struct {
+	// The maximum number of bytes the Writer sends in a single request.
+	// Each upload holds a buffer of this size. The library rounds it up to
+	// the nearest multiple of 256 KiB. Zero means 16 MiB, we never hand the
+	// Writer a ChunkSize of 0 since that turns off retries
+	ChunkSize int
+
+	// Uploads we know are smaller than this are sent in a single request,
+	// with a buffer that is only as big as the file.
+	// We only know the size with WithTotalSize or a reader like bytes.Reader
+	SingleRequestThreshold int64
+
+	// How long a single chunk keeps getting retried before we give up.
+	// Zero keeps the library default of 32s
+	ChunkRetryDeadline time.Duration
+
+	// The part size of UploadFileParallel, unless the call sets its own.
+	// Zero means DefaultPartSize
+	PartSize int64
+
+	// Reuse the copy buffers and the parallel upload part buffers between uploads.
+	// The Writer's own ChunkSize buffer is allocated by the library and can't be pooled
+	PoolBuffers bool
+}
+
+// The defaults match what UploadFile has always done
+func DefaultUploadOptions() UploadOptions {
+	return UploadOptions{
+		ChunkSize:              defaultChunkSize,
+		SingleRequestThreshold: defaultChunkSize,
+		PartSize:               DefaultPartSize,
+		PoolBuffers:            true,
+	}
+}
+
+// Creates a Writer with the upload options applied.
+// Pass a size of -1 when the size is unknown
+func (s *Store) newWriter(
+	ctx context.Context,
+	obj *storage.ObjectHandle,
+	size int64,
+) *storage.Writer {
+	writer := obj.NewWriter(ctx)
+	writer.ChunkSize = s.Upload.chunkSizeFor(size)
+	writer.ChunkRetryDeadline = s.Upload.ChunkRetryDeadline
+	return writer
+}
+
+// We don't use ChunkSize = 0 for small files since that disables retries.
+// Instead, we pick a chunk that is just big enough for the whole file.
+// It has to be strictly bigger, otherwise the Writer starts a resumable upload
+func (o UploadOptions) chunkSizeFor(size int64) int {
+	// A Store built as a literal has no upload options at all
+	chunkSize := o.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	if size < 0 || size >= o.SingleRequestThreshold {
+		return chunkSize
+	}
+
+	tight := int((size/chunkSizeMultiple + 1) * chunkSizeMultiple)
+	return min(tight, chunkSize)
+}
+
+// The part size of UploadFileParallel when the call doesn't set one
+func (o UploadOptions) partSize() int64 {
+	if o.PartSize <= 0 {
+		return DefaultPartSize
+	}
+	return o.PartSize
+}
+
+// ===================================
+// BUFFER POOLS
+// ===================================
+//
+// Only our own buffers are pooled: the copy buffer of UploadFile and the
+// part buffers of UploadFileParallel. The Writer allocates its ChunkSize
+// buffer internally, so for that one the only knob is a smaller ChunkSize.
+//
+// There is a sync.Pool per size, but only for the copy buffer size and the
+// configured PartSize, so the number of pools is bounded by the number of
+// configurations. Any other size (a part size passed to a single call, or
+// one grown to fit in 1024 parts) is allocated and left to the GC.
+// https://pkg.go.dev/sync#Pool
+
+var bufferPools sync.Map // map[int]*sync.Pool
+
+func (o UploadOptions) pooled(size int) bool {
+	return o.PoolBuffers && (size == copyBufferSize || int64(size) == o.partSize())
+}
+
+// Gets a buffer of exactly size bytes. Hand it back with putBuffer
+func (o UploadOptions) getBuffer(size int) []byte {
+	if !o.pooled(size) {
+		return make([]byte, size)
+	}
+
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		},
+	})
+	return *pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func (o UploadOptions) putBuffer(buf []byte) {
+	buf = buf[:cap(buf)]
+	if !o.pooled(len(buf)) {
+		return
+	}
+
+	if pool, ok := bufferPools.Load(len(buf)); ok {
+		pool.(*sync.Pool).Put(&buf)
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestChunkSizeFor(t *testing.T) {
+	const (
+		kib = 1024
+		mib = 1024 * kib
+	)
+
+	opts := UploadOptions{
+		ChunkSize:              16 * mib,
+		SingleRequestThreshold: 8 * mib,
+	}
+
+	tests := []struct {
+		size     int64
+		expected int
+	}{
+		{-1, 16 * mib},         // Unknown size, so we need the full buffer
+		{0, 256 * kib},         // Empty file
+		{100, 256 * kib},       // Tiny file only needs the smallest chunk
+		{256 * kib, 512 * kib}, // Must be strictly bigger than the file
+		{5 * mib, 5*mib + 256*kib},
+		{8 * mib, 16 * mib}, // Over the threshold
+		{1024 * mib, 16 * mib},
+	}
+
+	for _, test := range tests {
+		if result := opts.chunkSizeFor(test.size); result != test.expected {
+			t.Errorf("chunkSizeFor(%d): expected %d, got %d", test.size, test.expected, result)
+		}
+	}
+
+	t.Run("Zero chunk size falls back to the default", func(t *testing.T) {
+		opts := UploadOptions{}
+		if result := opts.chunkSizeFor(-1); result != 16*mib {
+			t.Errorf("Expected a chunk size of %d, got %d", 16*mib, result)
+		}
+		if result := opts.chunkSizeFor(100); result != 16*mib {
+			t.Errorf("Expected a chunk size of %d, got %d", 16*mib, result)
+		}
+	})
+
+	t.Run("Never bigger than the chunk size", func(t *testing.T) {
+		opts := UploadOptions{ChunkSize: 256 * kib, SingleRequestThreshold: 8 * mib}
+		if result := opts.chunkSizeFor(1 * mib); result != 256*kib {
+			t.Errorf("Expected a chunk size of %d, got %d", 256*kib, result)
+		}
+	})
+}
+
+func TestNewWriter(t *testing.T) {
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	t.Run("A Store literal still retries", func(t *testing.T) {
+		s := &Store{Client: client, BucketName: "bucket"}
+		writer := s.newWriter(context.Background(), s.getObject("file.txt"), -1)
+		if writer.ChunkSize != 16*1024*1024 {
+			t.Errorf("Expected a chunk size of 16 MiB, got %d", writer.ChunkSize)
+		}
+	})
+
+	t.Run("Options are applied", func(t *testing.T) {
+		opts := DefaultStoreOptions()
+		opts.Upload.ChunkRetryDeadline = time.Minute
+		s := NewStoreWithOptions(client, "bucket", "", opts)
+
+		writer := s.newWriter(context.Background(), s.getObject("file.txt"), 100)
+		if writer.ChunkSize != 256*1024 {
+			t.Errorf("Expected a chunk size of 256 KiB, got %d", writer.ChunkSize)
+		}
+		if writer.ChunkRetryDeadline != time.Minute {
+			t.Errorf("Expected a chunk retry deadline of 1m, got %v", writer.ChunkRetryDeadline)
+		}
+	})
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, pooled := range []bool{true, false} {
+		opts := UploadOptions{PartSize: 1234, PoolBuffers: pooled}
+
+		for _, size := range []int{copyBufferSize, 1234, 4321} {
+			buf := opts.getBuffer(size)
+			if len(buf) != size {
+				t.Fatalf("Expected a buffer of %d bytes, got %d", size, len(buf))
+			}
+			opts.putBuffer(buf[:10])
+
+			// Whatever we get back has to be the full size again
+			if buf := opts.getBuffer(size); len(buf) != size {
+				t.Fatalf("Expected a buffer of %d bytes, got %d", size, len(buf))
+			}
+		}
+	}
+
+	// Sizes nobody configured don't get a pool of their own
+	if _, ok := bufferPools.Load(4321); ok {
+		t.Errorf("Expected no pool for an unconfigured size")
+	}
+	if _, ok := bufferPools.Load(1234); !ok {
+		t.Errorf("Expected a pool for the configured part size")
+	}
+}